@@ -1,12 +1,14 @@
 package jrpc2
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 
 	"github.com/herenow/jrpc2/channel"
 	"github.com/herenow/jrpc2/code"
+	"github.com/herenow/jrpc2/internal/canon"
 )
 
 // A Request is a request message from a client to a server.
@@ -32,6 +34,10 @@ func (r *Request) HasParams() bool { return len(r.params) != 0 }
 // UnmarshalParams decodes the parameters into v.
 func (r *Request) UnmarshalParams(v interface{}) error { return json.Unmarshal(r.params, v) }
 
+// RawParams returns the encoded parameters of r, or nil if it has none. The
+// caller must not modify the contents of the slice.
+func (r *Request) RawParams() json.RawMessage { return r.params }
+
 // A Response is a response message from a server to a client.
 type Response struct {
 	id     string
@@ -46,7 +52,8 @@ type Response struct {
 	cancel func()
 }
 
-// ID returns the request identifier for r.
+// ID returns the request identifier for r, as its JSON encoding. For example,
+// the string ID abc is reported as "abc", with the quotation marks.
 func (r *Response) ID() string { return r.id }
 
 // Error returns a non-nil *Error if the response contains an error.
@@ -67,6 +74,15 @@ func (r *Response) UnmarshalResult(v interface{}) error {
 	return json.Unmarshal(r.result, v)
 }
 
+// RawResult returns the encoded result of r, or nil if the request failed.
+// The caller must not modify the contents of the slice.
+func (r *Response) RawResult() json.RawMessage {
+	if r.err != nil {
+		return nil
+	}
+	return r.result
+}
+
 // wait blocks until p is complete. It is safe to call this multiple times and
 // from concurrent goroutines.
 func (r *Response) wait() {
@@ -79,7 +95,6 @@ func (r *Response) wait() {
 		// The first waiter must update the response value, THEN close the
 		// channel and cancel the context. This order ensures that subsequent
 		// waiters all get the same response, and do not race on accessing it.
-		r.id = string(fixID(raw.ID))
 		r.err = raw.E.toError()
 		r.result = raw.R
 		close(r.ch)
@@ -98,14 +113,30 @@ func (j jrequests) MarshalJSON() ([]byte, error) {
 	return json.Marshal([]*jrequest(j))
 }
 
+// UnmarshalJSON decodes each element of a batch separately, so that an invalid
+// element does not spoil the rest of the batch. An element that is not a valid
+// request object is retained with its err field set, and with as much of its
+// content (notably its ID) as could be decoded.
 func (j *jrequests) UnmarshalJSON(data []byte) error {
 	if len(data) == 0 {
 		return errors.New("empty request message")
-	} else if data[0] != '[' {
-		*j = jrequests{new(jrequest)}
-		return json.Unmarshal(data, (*j)[0])
 	}
-	return json.Unmarshal(data, (*[]*jrequest)(j))
+	msgs := []json.RawMessage{data}
+	if data[0] == '[' {
+		msgs = nil
+		if err := json.Unmarshal(data, &msgs); err != nil {
+			return err
+		}
+	}
+	*j = make(jrequests, len(msgs))
+	for i, msg := range msgs {
+		req := new(jrequest)
+		if err := json.Unmarshal(msg, req); err != nil {
+			req.err = invalidRequest(err)
+		}
+		(*j)[i] = req
+	}
+	return nil
 }
 
 // jrequest is the transmission format of a request message.
@@ -114,6 +145,8 @@ type jrequest struct {
 	ID json.RawMessage `json:"id,omitempty"` // rendered by the constructor, may be nil
 	M  string          `json:"method"`
 	P  json.RawMessage `json:"params,omitempty"` // rendered by the constructor
+
+	err error // set during decoding if this is not a valid request object
 }
 
 func (j *jrequest) UnmarshalJSON(data []byte) error {
@@ -121,11 +154,31 @@ func (j *jrequest) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, (*stub)(j)); err != nil {
 		return err
 	} else if len(j.P) != 0 && j.P[0] != '[' && j.P[0] != '{' {
-		return DataErrorf(code.InvalidRequest, j.ID, "parameters must be list or object")
+		return Errorf(code.InvalidRequest, "parameters must be list or object")
 	}
 	return nil
 }
 
+// invalidRequest converts an error from decoding a request object into an
+// error with code InvalidRequest.
+func invalidRequest(err error) error {
+	switch t := err.(type) {
+	case *Error:
+		return t
+	case *json.UnmarshalTypeError:
+		if t.Field != "" {
+			return Errorf(code.InvalidRequest, "invalid request: %s has wrong type %s", t.Field, t.Value)
+		}
+	}
+	return Errorf(code.InvalidRequest, "invalid request object")
+}
+
+// isArray reports whether data, which must be valid JSON, encodes an array.
+func isArray(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) != 0 && data[0] == '['
+}
+
 // jresponses is a slice of responses, encoded as a single response if there is
 // exactly one.
 type jresponses []*jresponse
@@ -188,6 +241,27 @@ func jerrorf(code code.Code, msg string, args ...interface{}) *jerror {
 	}
 }
 
+// canonicalID returns a canonical encoding of id, so that IDs that differ only
+// in their JSON encoding (for example, in the escapes used in a string) compare
+// equal. It returns "" if id is empty.
+func canonicalID(id json.RawMessage) string {
+	simple := true
+	for _, b := range id {
+		if b < '0' || b > '9' {
+			simple = false
+			break
+		}
+	}
+	if simple {
+		return string(id) // the common case, a small integer
+	}
+	bits, err := canon.JSON(id)
+	if err != nil {
+		return string(id)
+	}
+	return string(bits)
+}
+
 // fixID filters id, treating "null" as a synonym for an unset ID.  This
 // supports interoperation with JSON-RPC v1 where "null" is used as an ID for
 // notifications.
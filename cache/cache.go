@@ -0,0 +1,444 @@
+// Package cache implements response caching for idempotent JSON-RPC methods.
+//
+// A Cache is a size-bounded least-recently-used map from requests to encoded
+// results, whose entries may expire after a fixed interval. Requests are
+// identified by their method name and parameters; parameters are compared
+// after canonicalization, so that two requests differing only in the order of
+// object keys or in the use of whitespace share the same entry.
+//
+// On the server side, NewAssigner wraps a jrpc2.Assigner so that the results
+// of its handlers are memoized:
+//
+//    srv := jrpc2.NewServer(cache.NewAssigner(assigner, &cache.Options{
+//       Methods: []string{"Lookup", "Status"},
+//       TTL:     5 * time.Second,
+//    }), nil)
+//
+// On the client side, NewClient wraps a *jrpc2.Client so that the results of
+// CallResult are memoized:
+//
+//    cc := cache.NewClient(cli, &cache.Options{MaxEntries: 100})
+//    if err := cc.CallResult(ctx, "Lookup", params, &result); err != nil {
+//       log.Fatal(err)
+//    }
+//
+// Only successful results are cached; errors are always passed through.
+//
+// On the server side, results (whether cached or coalesced) are shared only
+// between callers with the same identity, which by default combines the
+// principal established by authentication and the session value of the
+// connection. Set Options.Identity to change this.
+//
+// For expensive methods whose results should not be retained, Coalesce wraps a
+// jrpc2.Assigner so that concurrent identical calls share a single execution
+// of the handler, without caching the result afterward.
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"bitbucket.org/creachadair/stringset"
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/internal/canon"
+	"github.com/herenow/jrpc2/metrics"
+)
+
+// Options control the behaviour of a Cache. A nil *Options provides sensible
+// defaults.
+type Options struct {
+	// The maximum number of entries to retain. If this is less than 1, a
+	// default limit of 1024 entries is used.
+	MaxEntries int
+
+	// The maximum total size in bytes of the cached results, including their
+	// keys. If this is less than 1, the size of entries is not limited.
+	MaxBytes int
+
+	// How long an entry remains valid after it is stored. If this is zero,
+	// entries do not expire, but may still be evicted to make room for others.
+	TTL time.Duration
+
+	// If non-empty, only the methods named here are cached; the results of
+	// other methods are passed through unchanged. If empty, all methods are
+	// cached.
+	Methods []string
+
+	// If set, record cache hits and misses here, as counters "cache.hits" and
+	// "cache.misses". If unset, an assigner created by NewAssigner uses the
+	// metrics of the server handling the request, and a client created by
+	// NewClient does not record metrics.
+	Metrics *metrics.M
+
+	// If set, this function reports the identity of the caller of a request
+	// handled by an assigner created by NewAssigner or Coalesce. A result is
+	// only shared between callers with the same identity as the caller for
+	// which it was computed, since another caller may not be entitled to see
+	// it. If
+	// nil, the identity combines the jrpc2.Principal and jrpc2.ServerSession
+	// values of the request context. A function that always returns "" shares
+	// results among all callers, which is safe only for methods whose results
+	// do not depend on the caller.
+	Identity func(ctx context.Context, req *jrpc2.Request) string
+}
+
+func (o *Options) maxEntries() int {
+	if o == nil || o.MaxEntries < 1 {
+		return 1024
+	}
+	return o.MaxEntries
+}
+
+func (o *Options) maxBytes() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxBytes
+}
+
+func (o *Options) ttl() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.TTL
+}
+
+func (o *Options) methods() stringset.Set {
+	if o == nil || len(o.Methods) == 0 {
+		return nil
+	}
+	return stringset.New(o.Methods...)
+}
+
+func (o *Options) metrics() *metrics.M {
+	if o == nil {
+		return nil
+	}
+	return o.Metrics
+}
+
+type identifier = func(context.Context, *jrpc2.Request) string
+
+func (o *Options) identity() identifier {
+	if o == nil || o.Identity == nil {
+		return defaultIdentity
+	}
+	return o.Identity
+}
+
+// defaultIdentity identifies the caller of req by the principal and session
+// values of ctx. Values of reference types are identified by their address,
+// and other values by their contents.
+func defaultIdentity(ctx context.Context, req *jrpc2.Request) string {
+	p, s := jrpc2.Principal(ctx), jrpc2.ServerSession(ctx)
+	if p == nil && s == nil {
+		return ""
+	}
+	return identityOf(p) + "\x00" + identityOf(s)
+}
+
+func identityOf(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return fmt.Sprintf("%T@%p", v, v)
+	}
+	return fmt.Sprintf("%T=%#v", v, v)
+}
+
+// requestKey returns the key for req, whose caller is identified by id. The
+// key for a caller with no identity is the same as the key reported by Key.
+func requestKey(id identifier, ctx context.Context, req *jrpc2.Request, params json.RawMessage) (string, error) {
+	key, err := Key(req.Method(), params)
+	if err != nil {
+		return "", err
+	}
+	if who := id(ctx, req); who != "" {
+		// N.B. A key from Key begins with the method name, which cannot begin
+		// with a NUL for any method that is actually assigned.
+		key = "\x00" + strconv.Itoa(len(who)) + ":" + who + key
+	}
+	return key, nil
+}
+
+// A Cache is a least-recently-used cache of encoded method results. A *Cache
+// is safe for concurrent use by multiple goroutines.
+type Cache struct {
+	maxEntries int
+	maxBytes   int
+	ttl        time.Duration
+	methods    stringset.Set // if nil, all methods are cacheable
+	metrics    *metrics.M    // if nil, use the server metrics
+	identity   identifier    // identifies the caller of a request
+
+	mu    sync.Mutex
+	size  int                      // total size of the entries in bytes
+	lru   *list.List               // entries, most recently used at the front
+	byKey map[string]*list.Element // entries by key
+}
+
+type entry struct {
+	key     string
+	val     json.RawMessage
+	expires time.Time // zero if the entry does not expire
+}
+
+func (e *entry) size() int { return len(e.key) + len(e.val) }
+
+// New constructs a new empty Cache with the given options.
+func New(opts *Options) *Cache {
+	return &Cache{
+		maxEntries: opts.maxEntries(),
+		maxBytes:   opts.maxBytes(),
+		ttl:        opts.ttl(),
+		methods:    opts.methods(),
+		metrics:    opts.metrics(),
+		identity:   opts.identity(),
+		lru:        list.New(),
+		byKey:      make(map[string]*list.Element),
+	}
+}
+
+// Cacheable reports whether results for the named method may be stored in c.
+func (c *Cache) Cacheable(method string) bool {
+	return c.methods == nil || c.methods.Contains(method)
+}
+
+// Get returns the cached result for the given method and parameters, and
+// reports whether it was found.
+func (c *Cache) Get(method string, params json.RawMessage) (json.RawMessage, bool) {
+	key, err := Key(method, params)
+	if err != nil {
+		return nil, false
+	}
+	return c.get(key)
+}
+
+// get returns the cached result with the given key, and reports whether it was
+// found.
+func (c *Cache) get(key string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elt, ok := c.byKey[key]
+	if !ok {
+		return nil, false
+	}
+	e := elt.Value.(*entry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		c.removeLocked(elt)
+		return nil, false
+	}
+	c.lru.MoveToFront(elt)
+	return e.val, true
+}
+
+// Put stores result as the value for the given method and parameters,
+// replacing any previous value and evicting older entries as necessary to
+// respect the size limits of c. A result that is too large to be cached at
+// all is discarded.
+func (c *Cache) Put(method string, params, result json.RawMessage) {
+	key, err := Key(method, params)
+	if err != nil {
+		return
+	}
+	c.put(key, result)
+}
+
+// put stores result as the value for the given key, as described for Put.
+func (c *Cache) put(key string, result json.RawMessage) {
+	e := &entry{key: key, val: result}
+	if c.ttl > 0 {
+		e.expires = time.Now().Add(c.ttl)
+	}
+	if c.maxBytes > 0 && e.size() > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.byKey[key]; ok {
+		c.removeLocked(old)
+	}
+	c.byKey[key] = c.lru.PushFront(e)
+	c.size += e.size()
+	for c.lru.Len() > c.maxEntries || (c.maxBytes > 0 && c.size > c.maxBytes) {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// Len reports the number of entries currently stored in c, which may include
+// entries that have expired but not yet been evicted.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Clear discards all the entries in c.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.byKey = make(map[string]*list.Element)
+	c.size = 0
+}
+
+// removeLocked discards the entry at elt. The caller must hold c.mu.
+func (c *Cache) removeLocked(elt *list.Element) {
+	e := c.lru.Remove(elt).(*entry)
+	delete(c.byKey, e.key)
+	c.size -= e.size()
+}
+
+// count records a cache hit or miss in m, if it is not nil.
+func count(m *metrics.M, hit bool) {
+	if m == nil {
+		return
+	} else if hit {
+		m.Count("cache.hits", 1)
+	} else {
+		m.Count("cache.misses", 1)
+	}
+}
+
+// Key returns the cache key for a request with the given method and encoded
+// parameters. The parameters are decoded and re-encoded, so that requests
+// whose parameters differ only in the order of object keys and in whitespace
+// have the same key. It reports an error if params is not valid JSON.
+func Key(method string, params json.RawMessage) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(method)
+	buf.WriteByte(0)
+	if len(params) != 0 {
+		bits, err := canon.JSON(params)
+		if err != nil {
+			return "", err
+		}
+		buf.Write(bits)
+	}
+	return buf.String(), nil
+}
+
+// NewAssigner returns a jrpc2.Assigner that delegates to a, but whose handlers
+// for cacheable methods store their results in a new cache with the given
+// options, and return a cached result if one is available. Notifications are
+// not cached.
+func NewAssigner(a jrpc2.Assigner, opts *Options) *Assigner {
+	return &Assigner{base: a, cache: New(opts)}
+}
+
+// An Assigner is a jrpc2.Assigner whose handlers cache their results.
+type Assigner struct {
+	base  jrpc2.Assigner
+	cache *Cache
+}
+
+// Cache returns the cache used by a.
+func (a *Assigner) Cache() *Cache { return a.cache }
+
+// Assign implements part of the jrpc2.Assigner interface.
+func (a *Assigner) Assign(method string) jrpc2.Handler {
+	h := a.base.Assign(method)
+	if h == nil || !a.cache.Cacheable(method) {
+		return h
+	}
+	return handler{h: h, cache: a.cache}
+}
+
+// Names implements part of the jrpc2.Assigner interface.
+func (a *Assigner) Names() []string { return a.base.Names() }
+
+type handler struct {
+	h     jrpc2.Handler
+	cache *Cache
+}
+
+// Handle implements the jrpc2.Handler interface.
+func (h handler) Handle(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+	if req.IsNotification() {
+		return h.h.Handle(ctx, req)
+	}
+	var params json.RawMessage
+	if req.HasParams() {
+		if err := req.UnmarshalParams(&params); err != nil {
+			return nil, err
+		}
+	}
+	key, err := requestKey(h.cache.identity, ctx, req, params)
+	if err != nil {
+		return nil, err
+	}
+	m := h.cache.metrics
+	if m == nil {
+		m = jrpc2.ServerMetrics(ctx)
+	}
+	if val, ok := h.cache.get(key); ok {
+		count(m, true)
+		return val, nil
+	}
+	count(m, false)
+
+	v, err := h.h.Handle(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	result, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	h.cache.put(key, result)
+	return json.RawMessage(result), nil
+}
+
+// NewClient returns a Client that issues calls via cli, and caches the results
+// of calls to cacheable methods in a new cache with the given options.
+func NewClient(cli *jrpc2.Client, opts *Options) *Client {
+	return &Client{cli: cli, cache: New(opts)}
+}
+
+// A Client wraps a *jrpc2.Client with a cache of call results.
+type Client struct {
+	cli   *jrpc2.Client
+	cache *Cache
+}
+
+// Cache returns the cache used by c.
+func (c *Client) Cache() *Cache { return c.cache }
+
+// CallResult behaves as the CallResult method of the underlying client, save
+// that if method is cacheable and a result for the same method and params is
+// in the cache, it is decoded into result without issuing a call.
+func (c *Client) CallResult(ctx context.Context, method string, params, result interface{}) error {
+	if !c.cache.Cacheable(method) {
+		return c.cli.CallResult(ctx, method, params, result)
+	}
+	var bits json.RawMessage
+	if params != nil {
+		v, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		bits = v
+	}
+	if val, ok := c.cache.Get(method, bits); ok {
+		count(c.cache.metrics, true)
+		return json.Unmarshal(val, result)
+	}
+	count(c.cache.metrics, false)
+
+	var val json.RawMessage
+	if err := c.cli.CallResult(ctx, method, params, &val); err != nil {
+		return err
+	}
+	c.cache.Put(method, bits, val)
+	return json.Unmarshal(val, result)
+}
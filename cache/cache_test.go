@@ -0,0 +1,367 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/metrics"
+	"github.com/herenow/jrpc2/server"
+)
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{`{"x":1,"y":2}`, `{ "y": 2, "x": 1 }`, true},
+		{`[1, 2, 3]`, `[1,2,3]`, true},
+		{`[12345678901234567890]`, `[12345678901234567891]`, false},
+		{`{"x":1}`, `{"x":2}`, false},
+		{``, `null`, false},
+	}
+	for _, test := range tests {
+		ka, err := Key("M", json.RawMessage(test.a))
+		if err != nil {
+			t.Fatalf("Key(%#q): unexpected error: %v", test.a, err)
+		}
+		kb, err := Key("M", json.RawMessage(test.b))
+		if err != nil {
+			t.Fatalf("Key(%#q): unexpected error: %v", test.b, err)
+		}
+		if same := ka == kb; same != test.same {
+			t.Errorf("Keys for %#q and %#q: same=%v, want %v", test.a, test.b, same, test.same)
+		}
+	}
+	if ka, _ := Key("A", nil); ka == func() string { k, _ := Key("B", nil); return k }() {
+		t.Error("Keys for different methods are equal")
+	}
+}
+
+func TestCacheLimits(t *testing.T) {
+	c := New(&Options{MaxEntries: 2, TTL: 50 * time.Millisecond})
+	c.Put("M", json.RawMessage(`[1]`), json.RawMessage(`"one"`))
+	c.Put("M", json.RawMessage(`[2]`), json.RawMessage(`"two"`))
+	if _, ok := c.Get("M", json.RawMessage(`[1]`)); !ok {
+		t.Error("Get [1]: not found")
+	}
+
+	// Adding a third entry evicts the least-recently used, which is [2].
+	c.Put("M", json.RawMessage(`[3]`), json.RawMessage(`"three"`))
+	if _, ok := c.Get("M", json.RawMessage(`[2]`)); ok {
+		t.Error("Get [2]: found after eviction")
+	}
+	if v, ok := c.Get("M", json.RawMessage(`[3]`)); !ok || string(v) != `"three"` {
+		t.Errorf("Get [3]: got %s, %v; want three, true", string(v), ok)
+	}
+
+	// After the TTL, entries expire.
+	time.Sleep(100 * time.Millisecond)
+	if v, ok := c.Get("M", json.RawMessage(`[1]`)); ok {
+		t.Errorf("Get [1]: got %s after expiry", string(v))
+	}
+
+	// Entries that exceed the byte limit are evicted or discarded.
+	c = New(&Options{MaxBytes: 16})
+	c.Put("M", nil, json.RawMessage(`"a long result value"`))
+	if n := c.Len(); n != 0 {
+		t.Errorf("Len after oversize put: got %d, want 0", n)
+	}
+	c.Put("A", nil, json.RawMessage(`"abcdef"`))
+	c.Put("B", nil, json.RawMessage(`"abcdef"`))
+	if n := c.Len(); n != 1 {
+		t.Errorf("Len after second put: got %d, want 1", n)
+	}
+}
+
+func TestAssigner(t *testing.T) {
+	var ncalls int
+	a := NewAssigner(jrpc2.MapAssigner{
+		"Square": jrpc2.NewHandler(func(ctx context.Context, vs []int) (int, error) {
+			ncalls++
+			return vs[0] * vs[0], nil
+		}),
+		"Uncached": jrpc2.NewHandler(func(ctx context.Context) (int, error) {
+			ncalls++
+			return ncalls, nil
+		}),
+	}, &Options{Methods: []string{"Square"}})
+	m := metrics.New()
+	cli, wait := server.Local(a, &server.LocalOptions{
+		ServerOptions: &jrpc2.ServerOptions{Metrics: m, Concurrency: 1},
+	})
+	defer wait()
+	defer cli.Close()
+
+	ctx := context.Background()
+	for _, v := range []int{3, 4, 3, 3, 4} {
+		var got int
+		if err := cli.CallResult(ctx, "Square", []int{v}, &got); err != nil {
+			t.Fatalf("Call Square(%d): unexpected error: %v", v, err)
+		} else if got != v*v {
+			t.Errorf("Call Square(%d): got %d, want %d", v, got, v*v)
+		}
+	}
+	if ncalls != 2 {
+		t.Errorf("Square was called %d times, want 2", ncalls)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cli.Call(ctx, "Uncached", nil); err != nil {
+			t.Fatalf("Call Uncached: unexpected error: %v", err)
+		}
+	}
+	if ncalls != 4 {
+		t.Errorf("Handlers were called %d times, want 4", ncalls)
+	}
+
+	snap := metrics.Snapshot{Counter: make(map[string]int64)}
+	m.Snapshot(snap)
+	if hits, misses := snap.Counter["cache.hits"], snap.Counter["cache.misses"]; hits != 3 || misses != 2 {
+		t.Errorf("Metrics: got %d hits, %d misses; want 3, 2", hits, misses)
+	}
+}
+
+func TestAssignerIdentity(t *testing.T) {
+	shared := func(context.Context, *jrpc2.Request) string { return "" }
+	tests := []struct {
+		desc     string
+		identity func(context.Context, *jrpc2.Request) string
+		want     []string // results for alice, bob, alice, bob
+	}{
+		{"Default", nil, []string{"alice", "bob", "alice", "bob"}},
+		{"Shared", shared, []string{"alice", "alice", "alice", "alice"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			a := NewAssigner(jrpc2.MapAssigner{
+				"Whoami": jrpc2.NewHandler(func(ctx context.Context) (string, error) {
+					return jrpc2.Principal(ctx).(string), nil
+				}),
+			}, &Options{Identity: test.identity})
+
+			// connect returns a client whose calls are authenticated as name.
+			connect := func(name string) (*jrpc2.Client, func() error) {
+				return server.Local(a, &server.LocalOptions{
+					ServerOptions: &jrpc2.ServerOptions{
+						Authenticate: func(context.Context, *jrpc2.Request) (interface{}, error) {
+							return name, nil
+						},
+					},
+				})
+			}
+			alice, waitAlice := connect("alice")
+			defer waitAlice()
+			defer alice.Close()
+			bob, waitBob := connect("bob")
+			defer waitBob()
+			defer bob.Close()
+
+			ctx := context.Background()
+			for i, cli := range []*jrpc2.Client{alice, bob, alice, bob} {
+				var got string
+				if err := cli.CallResult(ctx, "Whoami", nil, &got); err != nil {
+					t.Fatalf("Call %d: unexpected error: %v", i+1, err)
+				} else if got != test.want[i] {
+					t.Errorf("Call %d: got %q, want %q", i+1, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClient(t *testing.T) {
+	var ncalls int
+	cli, wait := server.Local(jrpc2.MapAssigner{
+		"Echo": jrpc2.NewHandler(func(ctx context.Context, req map[string]string) (map[string]string, error) {
+			ncalls++
+			return req, nil
+		}),
+	}, nil)
+	defer wait()
+	defer cli.Close()
+
+	m := metrics.New()
+	cc := NewClient(cli, &Options{Metrics: m})
+	ctx := context.Background()
+	for _, v := range []string{"a", "b", "a"} {
+		var got map[string]string
+		if err := cc.CallResult(ctx, "Echo", map[string]string{"v": v}, &got); err != nil {
+			t.Fatalf("CallResult Echo(%q): unexpected error: %v", v, err)
+		} else if got["v"] != v {
+			t.Errorf("CallResult Echo(%q): got %v", v, got)
+		}
+	}
+	if ncalls != 2 {
+		t.Errorf("Echo was called %d times, want 2", ncalls)
+	}
+	snap := metrics.Snapshot{Counter: make(map[string]int64)}
+	m.Snapshot(snap)
+	if hits, misses := snap.Counter["cache.hits"], snap.Counter["cache.misses"]; hits != 1 || misses != 2 {
+		t.Errorf("Metrics: got %d hits, %d misses; want 1, 2", hits, misses)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var mu sync.Mutex
+	var ncalls int
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+	c := Coalesce(jrpc2.MapAssigner{
+		"Report": jrpc2.NewHandler(func(ctx context.Context, vs []int) (int, error) {
+			mu.Lock()
+			ncalls++
+			n := ncalls
+			mu.Unlock()
+			select {
+			case <-release:
+				return n, nil
+			case <-ctx.Done():
+				close(cancelled)
+				return 0, ctx.Err()
+			}
+		}),
+	}, nil)
+	cli, wait := server.Local(c, &server.LocalOptions{
+		ServerOptions: &jrpc2.ServerOptions{Concurrency: 8},
+	})
+	defer wait()
+	defer cli.Close()
+
+	// waitFor blocks until n callers are waiting for the execution with the
+	// given params.
+	waitFor := func(params string, n int) {
+		t.Helper()
+		key, _ := Key("Report", json.RawMessage(params))
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+			c.mu.Lock()
+			f := c.calls[key]
+			got := 0
+			if f != nil {
+				got = f.waiters
+			}
+			c.mu.Unlock()
+			if got == n {
+				return
+			}
+		}
+		t.Fatalf("Timed out waiting for %d callers", n)
+	}
+
+	// Concurrent identical calls share a single execution.
+	ctx := context.Background()
+	const numCalls = 5
+	results := make(chan int, numCalls)
+	for i := 0; i < numCalls; i++ {
+		go func() {
+			var v int
+			if err := cli.CallResult(ctx, "Report", []int{1}, &v); err != nil {
+				t.Errorf("Call Report: unexpected error: %v", err)
+			}
+			results <- v
+		}()
+	}
+	waitFor("[1]", numCalls)
+	close(release)
+	for i := 0; i < numCalls; i++ {
+		if v := <-results; v != 1 {
+			t.Errorf("Call Report: got %d, want 1", v)
+		}
+	}
+
+	// A cancelled caller returns without affecting the others; when all of
+	// them are gone, the shared execution is cancelled.
+	release = make(chan struct{})
+	ctx1, cancel1 := context.WithCancel(ctx)
+	ctx2, cancel2 := context.WithCancel(ctx)
+	errs := make(chan error, 2)
+	for _, ctx := range []context.Context{ctx1, ctx2} {
+		ctx := ctx
+		go func() { _, err := cli.Call(ctx, "Report", []int{2}); errs <- err }()
+	}
+	waitFor("[2]", 2)
+	cancel1()
+	if err := <-errs; err == nil {
+		t.Error("Call Report: got nil error after cancellation")
+	}
+	waitFor("[2]", 1)
+	select {
+	case <-cancelled:
+		t.Fatal("Shared execution cancelled while a caller is waiting")
+	default:
+	}
+	cancel2()
+	<-errs
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("Shared execution was not cancelled")
+	}
+}
+
+func TestCoalesceIdentity(t *testing.T) {
+	entered := make(chan string, 2)
+	release := make(chan struct{})
+	c := Coalesce(jrpc2.MapAssigner{
+		"Whoami": jrpc2.NewHandler(func(ctx context.Context) (string, error) {
+			who := jrpc2.Principal(ctx).(string)
+			entered <- who
+			<-release
+			return who, nil
+		}),
+	}, nil)
+
+	// connect returns a client whose calls are authenticated as name.
+	connect := func(name string) (*jrpc2.Client, func() error) {
+		return server.Local(c, &server.LocalOptions{
+			ServerOptions: &jrpc2.ServerOptions{
+				Authenticate: func(context.Context, *jrpc2.Request) (interface{}, error) {
+					return name, nil
+				},
+			},
+		})
+	}
+	alice, waitAlice := connect("alice")
+	defer waitAlice()
+	defer alice.Close()
+	bob, waitBob := connect("bob")
+	defer waitBob()
+	defer bob.Close()
+
+	// Identical concurrent calls from different principals do not share an
+	// execution, so each sees its own principal.
+	ctx := context.Background()
+	results := make(chan error, 2)
+	for _, test := range []struct {
+		cli  *jrpc2.Client
+		want string
+	}{{alice, "alice"}, {bob, "bob"}} {
+		test := test
+		go func() {
+			var got string
+			err := test.cli.CallResult(ctx, "Whoami", nil, &got)
+			if err == nil && got != test.want {
+				err = fmt.Errorf("got %q, want %q", got, test.want)
+			}
+			results <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case who := <-entered:
+			t.Logf("Execution for %q started", who)
+		case <-time.After(5 * time.Second):
+			close(release)
+			t.Fatal("Calls from different principals were coalesced")
+		}
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("Call Whoami: %v", err)
+		}
+	}
+}
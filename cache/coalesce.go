@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"bitbucket.org/creachadair/stringset"
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/metrics"
+)
+
+// Coalesce returns a jrpc2.Assigner that delegates to a, but whose handlers
+// for the selected methods combine concurrent calls having the same method and
+// parameters into a single execution of the underlying handler. Every caller
+// receives the result of that execution. Unlike a Cache, a result is not
+// retained once the execution is complete.
+//
+// Only the Methods, Metrics and Identity fields of opts are used. When a call
+// joins an execution already in progress, Coalesce records a
+// "cache.coalesced" counter.
+//
+// Calls are combined only if their callers have the same identity, as
+// described for Options.Identity, because the shared execution receives a
+// context with the values of the first caller's context, including its
+// principal and session. Each caller waits only as long as its own context
+// allows, so a caller whose request is cancelled (for example, by rpc.cancel)
+// returns at once without affecting the others. The shared execution is
+// cancelled only when every caller waiting for its result has gone away.
+func Coalesce(a jrpc2.Assigner, opts *Options) *Coalescer {
+	return &Coalescer{
+		base:    a,
+		methods: opts.methods(),
+		metrics: opts.metrics(),
+		ident:   opts.identity(),
+		calls:   make(map[string]*flight),
+	}
+}
+
+// A Coalescer is a jrpc2.Assigner whose handlers combine concurrent identical
+// calls into a single execution.
+type Coalescer struct {
+	base    jrpc2.Assigner
+	methods stringset.Set // if nil, all methods are coalesced
+	metrics *metrics.M    // if nil, use the server metrics
+	ident   identifier    // identifies the caller of a request
+
+	mu    sync.Mutex
+	calls map[string]*flight // executions in progress, by key
+}
+
+// A flight is a single execution of a handler shared by one or more callers.
+type flight struct {
+	done    chan struct{}      // closed when the execution is complete
+	cancel  context.CancelFunc // cancels the context of the execution
+	waiters int                // callers waiting for the result
+
+	val json.RawMessage // the result (when complete)
+	err error           // the error (when complete)
+}
+
+// Assign implements part of the jrpc2.Assigner interface.
+func (c *Coalescer) Assign(method string) jrpc2.Handler {
+	h := c.base.Assign(method)
+	if h == nil || (c.methods != nil && !c.methods.Contains(method)) {
+		return h
+	}
+	return coalescer{h: h, c: c}
+}
+
+// Names implements part of the jrpc2.Assigner interface.
+func (c *Coalescer) Names() []string { return c.base.Names() }
+
+type coalescer struct {
+	h jrpc2.Handler
+	c *Coalescer
+}
+
+// Handle implements the jrpc2.Handler interface.
+func (h coalescer) Handle(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+	if req.IsNotification() {
+		return h.h.Handle(ctx, req)
+	}
+	var params json.RawMessage
+	if req.HasParams() {
+		if err := req.UnmarshalParams(&params); err != nil {
+			return nil, err
+		}
+	}
+	key, err := requestKey(h.c.ident, ctx, req, params)
+	if err != nil {
+		return nil, err
+	}
+
+	c := h.c
+	c.mu.Lock()
+	f, ok := c.calls[key]
+	if ok {
+		m := c.metrics
+		if m == nil {
+			m = jrpc2.ServerMetrics(ctx)
+		}
+		if m != nil {
+			m.Count("cache.coalesced", 1)
+		}
+	} else {
+		fctx, cancel := context.WithCancel(detached{ctx})
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		c.calls[key] = f
+		go func() {
+			defer cancel()
+			v, err := h.h.Handle(fctx, req)
+			if err == nil {
+				f.val, err = json.Marshal(v)
+			}
+			f.err = err
+
+			c.mu.Lock()
+			if c.calls[key] == f {
+				delete(c.calls, key)
+			}
+			c.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		if f.err != nil {
+			return nil, f.err
+		}
+		return f.val, nil
+
+	case <-ctx.Done():
+		// This caller has given up. If it was the last one waiting, abandon
+		// the execution so that later callers will start a new one.
+		c.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			if c.calls[key] == f {
+				delete(c.calls, key)
+			}
+		}
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// detached is a context that carries the values of its parent, but not its
+// deadline or cancellation.
+type detached struct{ context.Context }
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
@@ -0,0 +1,96 @@
+//go:build go1.18
+// +build go1.18
+
+package channel
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A bufCloser is an io.WriteCloser that accumulates writes in memory.
+type bufCloser struct{ bytes.Buffer }
+
+func (*bufCloser) Close() error { return nil }
+
+// encodeAll returns the encoding of msgs using framing.
+func encodeAll(t testing.TB, framing Framing, msgs ...string) []byte {
+	var buf bufCloser
+	ch := framing(bytes.NewReader(nil), &buf)
+	for _, msg := range msgs {
+		if err := ch.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send %q: unexpected error: %v", msg, err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// fuzzRecv receives messages from data using framing until an error occurs,
+// and checks that each complete message survives a round trip through Send
+// and Recv.
+func fuzzRecv(t *testing.T, framing Framing, data []byte) {
+	ch := framing(bytes.NewReader(data), new(bufCloser))
+	for {
+		msg, err := ch.Recv()
+		if err != nil {
+			return
+		}
+		enc := encodeAll(t, framing, string(msg))
+		got, err := framing(bytes.NewReader(enc), new(bufCloser)).Recv()
+		if err != nil {
+			t.Fatalf("Recv after Send %q: unexpected error: %v", msg, err)
+		} else if !bytes.Equal(got, msg) {
+			t.Fatalf("Round trip: got %q, want %q", got, msg)
+		}
+	}
+}
+
+func FuzzVarintRecv(f *testing.F) {
+	for _, msg := range messages {
+		f.Add(encodeAll(f, Varint, msg))
+	}
+	f.Add(encodeAll(f, Varint, messages...))
+	f.Add([]byte("\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01{}"))
+	f.Fuzz(func(t *testing.T, data []byte) { fuzzRecv(t, Varint, data) })
+}
+
+func FuzzHeaderRecv(f *testing.F) {
+	for _, msg := range messages {
+		f.Add(encodeAll(f, JSON, msg))
+	}
+	f.Add(encodeAll(f, JSON, messages...))
+	f.Add([]byte("Content-Length: 99999999999\r\n\r\n{}"))
+	f.Add([]byte("Content-Length: -1\r\n\r\n"))
+	f.Add([]byte("Content-Type: text/plain\r\nContent-Length: 2\r\n\r\n{}"))
+	f.Fuzz(func(t *testing.T, data []byte) { fuzzRecv(t, JSON, data) })
+}
+
+func FuzzSplitRecv(f *testing.F) {
+	for _, msg := range messages {
+		f.Add(encodeAll(f, Line, msg))
+	}
+	f.Add(encodeAll(f, Line, messages...))
+	f.Add([]byte("unterminated"))
+	f.Add([]byte("\n\n\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzRecv(t, Line, data)
+
+		// Reassembling the received records must reproduce the input.
+		ch := Line(bytes.NewReader(data), new(bufCloser))
+		var got []byte
+		for {
+			msg, err := ch.Recv()
+			if bytes.IndexByte(msg, '\n') >= 0 {
+				t.Fatalf("Recv: record %q contains the split byte", msg)
+			}
+			got = append(got, msg...)
+			if err != nil {
+				break
+			}
+			got = append(got, '\n')
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Reassembled records: got %q, want %q", got, data)
+		}
+	})
+}
@@ -95,11 +95,11 @@ func (h *hdr) Recv() ([]byte, error) {
 		return nil, errors.New("negative content-length")
 	}
 
-	// We need to use ReadFull here because the buffered reader may not have a
-	// big enough buffer to deliver the whole message, and will only issue a
-	// single read to the underlying source.
-	data := make([]byte, size)
-	if _, err := io.ReadFull(h.rd, data); err != nil {
+	// The buffered reader may not have a big enough buffer to deliver the
+	// whole message, and will only issue a single read to the underlying
+	// source, so read until the full length has been received.
+	data, err := readN(h.rd, uint64(size))
+	if err != nil {
 		return nil, err
 	}
 	return data, nil
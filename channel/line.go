@@ -52,8 +52,10 @@ func (c split) Recv() ([]byte, error) {
 			continue // incomplete line
 		}
 		line := buf.Bytes()
-		if n := len(line) - 1; n >= 0 {
-			return line[:n], err
+		if err == nil {
+			return line[:len(line)-1], nil // discard the split byte
+		} else if len(line) != 0 {
+			return line, err // unterminated final record
 		}
 		return nil, err
 	}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
 	"math/bits"
 )
 
@@ -42,9 +43,27 @@ func (c *varint) Recv() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	out := make([]byte, int(ln))
-	nr, err := io.ReadFull(c.rd, out)
-	return out[:nr], err
+	return readN(c.rd, ln)
+}
+
+// readN reads exactly n bytes from r. It does not trust n to allocate space,
+// so that a corrupt length prefix cannot exhaust memory before the input is
+// found to be short. If fewer than n bytes are available, readN returns the
+// bytes read along with io.ErrUnexpectedEOF.
+func readN(r io.Reader, n uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	if n < 1<<16 {
+		buf.Grow(int(n))
+	}
+	limit := int64(math.MaxInt64)
+	if n < math.MaxInt64 {
+		limit = int64(n)
+	}
+	nr, err := io.Copy(&buf, io.LimitReader(r, limit))
+	if err == nil && uint64(nr) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
 }
 
 // Close implements part of the Channel interface.
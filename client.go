@@ -1,12 +1,12 @@
 package jrpc2
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"strconv"
 	"sync"
 
 	"github.com/herenow/jrpc2/channel"
@@ -27,7 +27,7 @@ type Client struct {
 	ch      channel.Channel      // channel to the server
 	err     error                // error from a previous operation
 	pending map[string]*Response // requests pending completion, by ID
-	nextID  int64                // next unused request ID
+	newID   idgen                // generates request IDs
 }
 
 // NewClient returns a new client that communicates with the server via ch.
@@ -42,6 +42,7 @@ func NewClient(ch channel.Channel, opts *ClientOptions) *Client {
 		// Lock-protected fields
 		ch:      ch,
 		pending: make(map[string]*Response),
+		newID:   opts.newID(),
 	}
 
 	// The main client loop reads responses from the server and delivers them
@@ -91,7 +92,7 @@ func (c *Client) accept(ch channel.Receiver) error {
 // the response; we just drop it in their channel.  The channel is buffered so
 // we don't need to rendezvous.
 func (c *Client) deliver(rsp *jresponse) {
-	if id := string(fixID(rsp.ID)); id == "" {
+	if id := canonicalID(fixID(rsp.ID)); id == "" {
 		if !c.snote(rsp) {
 			c.log("Discarding response without ID: %v", rsp)
 		}
@@ -123,10 +124,8 @@ func (c *Client) req(ctx context.Context, method string, params interface{}) (*R
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.nextID++
-	id := json.RawMessage(strconv.FormatInt(c.nextID, 10))
 	return &Request{
-		id:     id,
+		id:     c.newID(),
 		method: method,
 		params: bits,
 	}, nil
@@ -158,6 +157,8 @@ func (c *Client) send(ctx context.Context, reqs ...*Request) ([]*Response, error
 	defer c.mu.Unlock()
 	if c.err != nil {
 		return nil, c.err
+	} else if c.ch == nil {
+		return nil, errClientStopped // the server closed the channel
 	}
 	batch, err := c.newBatch(reqs)
 	if err != nil {
@@ -179,7 +180,7 @@ func (c *Client) send(ctx context.Context, reqs ...*Request) ([]*Response, error
 	// leave us with dead pending requests awaiting responses.
 	var pends []*Response
 	for _, req := range reqs {
-		if id := req.ID(); id != "" {
+		if id := canonicalID(req.id); id != "" {
 			pctx, p := newPending(ctx, id)
 			c.pending[id] = p
 			pends = append(pends, p)
@@ -194,7 +195,7 @@ func (c *Client) send(ctx context.Context, reqs ...*Request) ([]*Response, error
 func (c *Client) newBatch(reqs []*Request) (jrequests, error) {
 	batch := make(jrequests, len(reqs))
 	for i, req := range reqs {
-		if id := req.ID(); id != "" && c.pending[id] != nil {
+		if id := canonicalID(req.id); id != "" && c.pending[id] != nil {
 			return nil, fmt.Errorf("duplicate request ID %q", id)
 		}
 		batch[i] = &jrequest{
@@ -385,9 +386,13 @@ func (c *Client) marshalParams(ctx context.Context, params interface{}) (json.Ra
 	if params == nil {
 		return c.enctx(ctx, nil) // no parameters, that is OK
 	}
-	pbits, err := json.Marshal(params)
-	if err != nil {
+	var pbits []byte
+	if raw, ok := params.(json.RawMessage); ok && json.Valid(raw) {
+		pbits = bytes.TrimSpace(raw) // already encoded; the request encoder compacts it
+	} else if bits, err := json.Marshal(params); err != nil {
 		return nil, err
+	} else {
+		pbits = bits
 	}
 	if len(pbits) == 0 || (pbits[0] != '[' && pbits[0] != '{') {
 		// JSON-RPC requires that if parameters are provided at all, they are
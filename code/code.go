@@ -37,6 +37,9 @@ const (
 	SystemError      Code = -32098 // Errors from the operating environment
 	Cancelled        Code = -32097 // Request cancelled
 	DeadlineExceeded Code = -32096 // Request deadline exceeded
+	Unauthenticated  Code = -32095 // Request lacks valid credentials
+	PermissionDenied Code = -32094 // Caller may not invoke the method
+	RateLimited      Code = -32093 // Request rate limit exceeded
 )
 
 var stdError = map[Code]string{
@@ -50,6 +53,9 @@ var stdError = map[Code]string{
 	SystemError:      "system error",
 	Cancelled:        "request cancelled",
 	DeadlineExceeded: "deadline exceeded",
+	Unauthenticated:  "unauthenticated",
+	PermissionDenied: "permission denied",
+	RateLimited:      "rate limit exceeded",
 }
 
 // Register adds a new Code value with the specified message string.  This
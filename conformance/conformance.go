@@ -0,0 +1,286 @@
+// Package conformance provides a test suite that checks whether a JSON-RPC
+// server follows the JSON-RPC 2.0 specification.
+//
+// The suite consists of the examples from the specification, together with
+// some additional cases for invalid parameters, notifications in batches, and
+// null request IDs. The cases use the methods "subtract", "sum", "update",
+// "notify_hello", "notify_sum" and "get_data", as defined by the examples in
+// the specification; Service returns a reference implementation of these
+// methods. Any server, or proxy, that exports these methods may be checked:
+//
+//    func TestConformance(t *testing.T) {
+//       cpipe, spipe := channel.Pipe(channel.Line)
+//       srv := jrpc2.NewServer(conformance.Service(), nil).Start(spipe)
+//       defer srv.Wait()
+//       defer cpipe.Close()
+//       conformance.Run(t, cpipe)
+//    }
+//
+// Responses are compared after decoding, so that the order of object keys and
+// insignificant whitespace do not matter. The message text of errors and any
+// error data are ignored, since the specification does not define them.
+// Responses to a batch may be in any order.
+//
+// Because some cases are not valid JSON, the channel must use a framing that
+// does not depend on the content of the message, such as channel.Line or
+// channel.Varint, and not channel.RawJSON.
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/channel"
+	"github.com/herenow/jrpc2/code"
+	"github.com/herenow/jrpc2/internal/canon"
+)
+
+// A Case is a single conformance test case.
+type Case struct {
+	Name     string // a brief description of the case
+	Request  string // the message sent to the server
+	Response string // the expected response, or "" if none is expected
+}
+
+// Cases are the conformance test cases, in the order they are run.
+var Cases = []Case{
+	// Examples from the specification.
+	{"positional params",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": [42, 23], "id": 1}`,
+		`{"jsonrpc": "2.0", "result": 19, "id": 1}`},
+	{"positional params reversed",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": [23, 42], "id": 2}`,
+		`{"jsonrpc": "2.0", "result": -19, "id": 2}`},
+	{"named params",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": {"subtrahend": 23, "minuend": 42}, "id": 3}`,
+		`{"jsonrpc": "2.0", "result": 19, "id": 3}`},
+	{"named params reordered",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": {"minuend": 42, "subtrahend": 23}, "id": 4}`,
+		`{"jsonrpc": "2.0", "result": 19, "id": 4}`},
+	{"notification",
+		`{"jsonrpc": "2.0", "method": "update", "params": [1,2,3,4,5]}`,
+		``},
+	{"notification without params",
+		`{"jsonrpc": "2.0", "method": "foobar"}`,
+		``},
+	{"method not found",
+		`{"jsonrpc": "2.0", "method": "foobar", "id": "1"}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": "1"}`},
+	{"invalid JSON",
+		`{"jsonrpc": "2.0", "method": "foobar, "params": "bar", "baz]`,
+		`{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`},
+	{"invalid request object",
+		`{"jsonrpc": "2.0", "method": 1, "params": "bar"}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`},
+	{"batch with invalid JSON",
+		`[{"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"}, {"jsonrpc": "2.0", "method"]`,
+		`{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`},
+	{"empty batch",
+		`[]`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`},
+	{"invalid batch of one",
+		`[1]`,
+		`[{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}]`},
+	{"invalid batch",
+		`[1,2,3]`,
+		`[{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},` +
+			`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},` +
+			`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}]`},
+	{"mixed batch",
+		`[{"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},` +
+			`{"jsonrpc": "2.0", "method": "notify_hello", "params": [7]},` +
+			`{"jsonrpc": "2.0", "method": "subtract", "params": [42,23], "id": "2"},` +
+			`{"foo": "boo"},` +
+			`{"jsonrpc": "2.0", "method": "foo.get", "params": {"name": "myself"}, "id": "5"},` +
+			`{"jsonrpc": "2.0", "method": "get_data", "id": "9"}]`,
+		`[{"jsonrpc": "2.0", "result": 7, "id": "1"},` +
+			`{"jsonrpc": "2.0", "result": 19, "id": "2"},` +
+			`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},` +
+			`{"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": "5"},` +
+			`{"jsonrpc": "2.0", "result": ["hello", 5], "id": "9"}]`},
+	{"batch of notifications",
+		`[{"jsonrpc": "2.0", "method": "notify_sum", "params": [1,2,4]},` +
+			`{"jsonrpc": "2.0", "method": "notify_hello", "params": [7]}]`,
+		``},
+
+	// Additional cases.
+	{"invalid params",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": ["a", "b"], "id": 10}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32602, "message": "Invalid params"}, "id": 10}`},
+	{"params not structured",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": "bogus", "id": 11}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": 11}`},
+	{"missing version",
+		`{"method": "subtract", "params": [2, 1], "id": 12}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": 12}`},
+	{"invalid params in batch",
+		`[{"jsonrpc": "2.0", "method": "subtract", "params": [5, 2], "id": 13},` +
+			`{"jsonrpc": "2.0", "method": "subtract", "params": "bogus", "id": 14}]`,
+		`[{"jsonrpc": "2.0", "result": 3, "id": 13},` +
+			`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": 14}]`},
+	{"notification with invalid params",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": ["a", "b"]}`,
+		``},
+	{"notifications and a call in a batch",
+		`[{"jsonrpc": "2.0", "method": "update", "params": [1]},` +
+			`{"jsonrpc": "2.0", "method": "subtract", "params": [1, 1], "id": 15},` +
+			`{"jsonrpc": "2.0", "method": "update", "params": [2]}]`,
+		`[{"jsonrpc": "2.0", "result": 0, "id": 15}]`},
+	{"string ID",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": [3, 1], "id": "abc"}`,
+		`{"jsonrpc": "2.0", "result": 2, "id": "abc"}`},
+	{"null ID",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": [3, 1], "id": null}`,
+		`{"jsonrpc": "2.0", "result": 2, "id": null}`},
+}
+
+// probe is a request sent after a case that expects no response, to verify
+// that the server did not respond to the case.
+const (
+	probeRequest  = `{"jsonrpc": "2.0", "method": "subtract", "params": [2, 1], "id": "probe"}`
+	probeResponse = `{"jsonrpc": "2.0", "result": 1, "id": "probe"}`
+)
+
+// Timeout is the time Run waits for the server to respond to each case.
+var Timeout = 5 * time.Second
+
+// Run runs each of the Cases as a subtest of t, using ch to communicate with
+// the server. The cases must be run in order, since a failure may leave
+// unread responses on the channel. If the server does not respond to a case
+// within Timeout, the remaining cases are skipped.
+func Run(t *testing.T, ch channel.Channel) {
+	stuck := false
+	for _, c := range Cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			if stuck {
+				t.Skip("skipped because the server stopped responding")
+			}
+			errc := make(chan error, 1)
+			go func() { errc <- Check(ch, c) }()
+			select {
+			case err := <-errc:
+				if err != nil {
+					t.Error(err)
+				}
+			case <-time.After(Timeout):
+				stuck = true
+				t.Errorf("request %s: no response after %v", c.Request, Timeout)
+			}
+		})
+	}
+}
+
+// Check sends the request for c to the server via ch, and reports an error if
+// the response does not match. If c expects no response, Check follows the
+// request with a probe, and reports an error if anything other than the
+// response to the probe is received.
+func Check(ch channel.Channel, c Case) error {
+	if err := ch.Send([]byte(c.Request)); err != nil {
+		return fmt.Errorf("sending request: %v", err)
+	}
+	want := c.Response
+	if want == "" {
+		if err := ch.Send([]byte(probeRequest)); err != nil {
+			return fmt.Errorf("sending probe: %v", err)
+		}
+		want = probeResponse
+	}
+	got, err := ch.Recv()
+	if err != nil {
+		return fmt.Errorf("receiving response: %v", err)
+	}
+	if !Equal(got, []byte(want)) {
+		return fmt.Errorf("request %s\n got %s\nwant %s", c.Request, string(got), want)
+	}
+	return nil
+}
+
+// Equal reports whether got and want are equivalent JSON-RPC responses. Error
+// messages and error data are ignored, and the responses in a batch may occur
+// in any order, but a batch is not equivalent to a single response.
+func Equal(got, want []byte) bool {
+	g, gok := normalize(got)
+	w, wok := normalize(want)
+	return gok && wok && reflect.DeepEqual(g, w)
+}
+
+// normalize decodes a response or a batch of responses, removes the error
+// messages and data, and sorts the responses in a batch into a canonical
+// order. It reports false if data is not a valid response.
+func normalize(data []byte) (interface{}, bool) {
+	v, err := canon.Decode(data)
+	if err != nil {
+		return nil, false
+	}
+	strip := func(v interface{}) {
+		if obj, ok := v.(map[string]interface{}); ok {
+			if e, ok := obj["error"].(map[string]interface{}); ok {
+				delete(e, "message")
+				delete(e, "data")
+			}
+		}
+	}
+	if batch, ok := v.([]interface{}); ok {
+		keys := make([]string, len(batch))
+		for i, elt := range batch {
+			strip(elt)
+			bits, _ := json.Marshal(elt)
+			keys[i] = string(bits)
+		}
+		sort.Strings(keys)
+		return keys, true
+	}
+	strip(v)
+	return v, true
+}
+
+// Service returns a jrpc2.Assigner that implements the methods used by the
+// conformance cases, following the examples in the specification.
+func Service() jrpc2.Assigner {
+	ignore := jrpc2.NewHandler(func(ctx context.Context, req *jrpc2.Request) (bool, error) {
+		return true, nil
+	})
+	return jrpc2.MapAssigner{
+		"subtract":     jrpc2.NewHandler(subtract),
+		"sum":          jrpc2.NewHandler(sum),
+		"update":       ignore,
+		"notify_hello": ignore,
+		"notify_sum":   ignore,
+		"get_data": jrpc2.NewHandler(func(ctx context.Context) ([]interface{}, error) {
+			return []interface{}{"hello", 5}, nil
+		}),
+	}
+}
+
+func subtract(ctx context.Context, req *jrpc2.Request) (float64, error) {
+	var pos []float64
+	if err := req.UnmarshalParams(&pos); err == nil {
+		if len(pos) != 2 {
+			return 0, jrpc2.Errorf(code.InvalidParams, "wrong number of parameters")
+		}
+		return pos[0] - pos[1], nil
+	}
+	var named struct {
+		Minuend    *float64 `json:"minuend"`
+		Subtrahend *float64 `json:"subtrahend"`
+	}
+	if err := req.UnmarshalParams(&named); err != nil || named.Minuend == nil || named.Subtrahend == nil {
+		return 0, jrpc2.Errorf(code.InvalidParams, "invalid parameters")
+	}
+	return *named.Minuend - *named.Subtrahend, nil
+}
+
+func sum(ctx context.Context, vs ...float64) (float64, error) {
+	var total float64
+	for _, v := range vs {
+		total += v
+	}
+	return total, nil
+}
@@ -0,0 +1,51 @@
+package conformance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/channel"
+)
+
+func TestServer(t *testing.T) {
+	defer func(timeout time.Duration) { Timeout = timeout }(Timeout)
+	Timeout = time.Second
+
+	for _, framing := range []struct {
+		name string
+		f    channel.Framing
+	}{
+		{"Line", channel.Line},
+		{"Varint", channel.Varint},
+		{"LSP", channel.LSP},
+	} {
+		t.Run(framing.name, func(t *testing.T) {
+			cpipe, spipe := channel.Pipe(framing.f)
+			srv := jrpc2.NewServer(Service(), nil).Start(spipe)
+			defer srv.Wait()
+			defer cpipe.Close()
+			Run(t, cpipe)
+		})
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{`{"jsonrpc":"2.0","id":1,"result":2}`, `{"result":2, "id":1, "jsonrpc":"2.0"}`, true},
+		{`{"id":1,"error":{"code":1,"message":"a"}}`, `{"id":1,"error":{"code":1,"message":"b","data":3}}`, true},
+		{`{"id":1,"error":{"code":1}}`, `{"id":1,"error":{"code":2}}`, false},
+		{`[{"id":1},{"id":2}]`, `[{"id":2},{"id":1}]`, true},
+		{`[{"id":1}]`, `{"id":1}`, false},
+		{`{"id":1}`, `{"id":"1"}`, false},
+		{`{"id":1}`, `{"id":1`, false},
+	}
+	for _, test := range tests {
+		if got := Equal([]byte(test.a), []byte(test.b)); got != test.want {
+			t.Errorf("Equal(%#q, %#q): got %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
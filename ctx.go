@@ -55,6 +55,37 @@ func ServerPush(ctx context.Context, method string, params interface{}) error {
 
 type serverPushKey struct{}
 
+// ActiveServer returns the server that is handling the request associated
+// with the given context, or nil if ctx does not have one. The context passed
+// to a handler by *jrpc2.Server will include this value.
+//
+// This allows a handler to retain a reference to its server, for example to
+// send it notifications after the handler has returned.
+func ActiveServer(ctx context.Context) *Server {
+	if v := ctx.Value(activeServerKey{}); v != nil {
+		return v.(*Server)
+	}
+	return nil
+}
+
+type activeServerKey struct{}
+
+// ServerSession returns the session value associated with the given context,
+// or nil if ctx does not have one. The context passed to a handler by
+// *jrpc2.Server includes this value if the server was constructed with a
+// NewSession function.
+func ServerSession(ctx context.Context) interface{} { return ctx.Value(serverSessionKey{}) }
+
+type serverSessionKey struct{}
+
+// Principal returns the caller identity associated with the given context, or
+// nil if ctx does not have one. The context passed to a handler by
+// *jrpc2.Server will include this value if the server has an Authenticate
+// function that reported a non-nil principal for the request.
+func Principal(ctx context.Context) interface{} { return ctx.Value(principalKey{}) }
+
+type principalKey struct{}
+
 // ErrNotifyUnsupported is returned by ServerNotify if server notifications are
 // not enabled in the specified context.
 var ErrNotifyUnsupported = errors.New("server notifications are not enabled")
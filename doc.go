@@ -152,6 +152,46 @@ send an "rpc.cancel" notification to the server for that request's ID:
 The "rpc.cancel" method is automatically handled by the *Server implementation
 from this package.
 
+Authentication
+
+A server may identify its callers by setting the Authenticate field of its
+ServerOptions. This function is called before each request is dispatched, and
+may examine the request and its context (including any metadata decoded by
+DecodeContext) to establish a principal:
+
+   opts := &jrpc2.ServerOptions{
+      DecodeContext: jctx.Decode,
+      Authenticate: func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+         var meta struct{ Token string `json:"token"` }
+         if err := jctx.UnmarshalMetadata(ctx, &meta); err != nil {
+            return nil, err
+         }
+         return lookupUser(meta.Token)
+      },
+   }
+
+A handler can recover the principal using jrpc2.Principal(ctx).  Alternatively,
+a client may call the built-in "rpc.authenticate" method once, after which the
+principal it established applies to every request on the connection.  The
+Authorize option adds a per-request check that rejects calls with the error
+code code.PermissionDenied before the handler runs.
+
+Peers
+
+A Client and a Server each require exclusive use of their channel. To both
+serve requests and issue calls over a single connection, as in the Language
+Server Protocol, use a Peer:
+
+   peer := jrpc2.NewPeer(ch, assigner, nil)
+   peer.Handle("Progress", progressHandler)  // add a handler later
+   rsp, err := peer.Call(ctx, "Initialize", params)
+   ...
+   peer.Close()
+
+A Peer separates incoming requests, which are handled by its server, from
+responses to its own calls. Handlers may call back to the remote peer while
+handling a request.
+
 Services with Multiple Methods
 
 The examples above show a server with only one method using NewHandler; you
@@ -5,12 +5,18 @@
 //    go build github.com/herenow/jrpc2/examples/jsh
 //    ./jsh -port 8080
 //
+// If -token is set, callers must present the same value, either as request
+// metadata (jcall -meta '{"token":"..."}') or by calling rpc.authenticate
+// with parameters {"token":"..."} before issuing other requests.
+//
 // See also examples/jcl/jcl.go.
 package main
 
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -77,9 +83,32 @@ func Run(ctx context.Context, req *RunReq) (*RunResult, error) {
 	}, nil
 }
 
+// authToken is the format of the credential sent by callers.
+type authToken struct {
+	Token string `json:"token"`
+}
+
+// checkToken authenticates a request that carries the shared secret, either
+// as the parameters of rpc.authenticate or as request metadata.
+func checkToken(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+	var tok authToken
+	if req.Method() == "rpc.authenticate" {
+		if err := req.UnmarshalParams(&tok); err != nil {
+			return nil, jrpc2.Errorf(code.InvalidParams, "invalid credentials: %v", err)
+		}
+	} else if err := jctx.UnmarshalMetadata(ctx, &tok); err != nil {
+		return nil, errors.New("missing token")
+	}
+	if subtle.ConstantTimeCompare([]byte(tok.Token), []byte(*token)) != 1 {
+		return nil, errors.New("invalid token")
+	}
+	return "admin", nil
+}
+
 var (
 	port    = flag.Int("port", 0, "Service port")
 	logging = flag.Bool("log", false, "Enable verbose logging")
+	token   = flag.String("token", "", "Require callers to present this token")
 
 	lw *log.Logger
 )
@@ -98,13 +127,15 @@ func main() {
 	}
 	log.Printf("Listening for connections at %s...", lst.Addr())
 
+	opts := &jrpc2.ServerOptions{
+		AllowV1:       true,
+		Logger:        lw,
+		DecodeContext: jctx.Decode,
+	}
+	if *token != "" {
+		opts.Authenticate = checkToken
+	}
 	server.Loop(lst, jrpc2.MapAssigner{
 		"Run": jrpc2.NewHandler(Run),
-	}, &server.LoopOptions{
-		ServerOptions: &jrpc2.ServerOptions{
-			AllowV1:       true,
-			Logger:        lw,
-			DecodeContext: jctx.Decode,
-		},
-	})
+	}, &server.LoopOptions{ServerOptions: opts})
 }
@@ -0,0 +1,280 @@
+// Package fanout implements scatter-gather calls, which send the same request
+// to several JSON-RPC servers concurrently and combine their replies.
+//
+// Each server is reached through a Backend, which pairs a *jrpc2.Client with
+// a name that identifies it in errors. The Call function issues a request to
+// all the backends and combines the results according to a Strategy:
+//
+//    backends := []fanout.Backend{
+//       {Name: "shard-a", Client: cliA},
+//       {Name: "shard-b", Client: cliB},
+//       {Name: "shard-c", Client: cliC},
+//    }
+//    result, err := fanout.Call(ctx, backends, "Lookup", params, fanout.Quorum(2))
+//
+// The strategies provided are FirstSuccess, All, Quorum and Merge. As soon as
+// the strategy has the results it needs, calls still pending on the other
+// backends are cancelled.
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/herenow/jrpc2"
+)
+
+// A Backend is a named client for one of the servers of a fan-out call.
+type Backend struct {
+	Name   string
+	Client *jrpc2.Client
+}
+
+// A Result records the outcome of a call to one backend.
+type Result struct {
+	Name     string          // the name of the backend
+	Response *jrpc2.Response // the response, if the call succeeded
+	Err      *Error          // the error, if the call failed
+}
+
+// An Error reports the failure of a call to a backend.
+type Error struct {
+	Name string // the name of the backend
+	Err  error  // the error reported by the call
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string { return e.Name + ": " + e.Err.Error() }
+
+// Unwrap returns the error reported by the call.
+func (e *Error) Unwrap() error { return e.Err }
+
+// Errors is the error reported when a fan-out call fails because of the
+// errors of one or more backends.
+type Errors []*Error
+
+// Error implements the error interface.
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// errorsOf returns the errors of the given results, or nil if there are none.
+func errorsOf(results []*Result) error {
+	var errs Errors
+	for _, r := range results {
+		if r != nil && r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// A Strategy determines when a fan-out call is complete, and combines the
+// results of the backends into the result of the call.
+//
+// Both methods are passed a slice with one entry for each backend, in the
+// order the backends were given to Call. The entry for a backend is nil if its
+// result has not yet been received.
+type Strategy interface {
+	// Done reports whether the call is complete. It is called each time a
+	// result is received. When it reports true, or when all the results have
+	// been received, Combine is called and any pending calls are cancelled.
+	Done(results []*Result) bool
+
+	// Combine returns the result of the call. If the result is not already a
+	// json.RawMessage, it is encoded as JSON.
+	Combine(results []*Result) (interface{}, error)
+}
+
+// Call sends a request for method with the given params to each of the
+// backends concurrently, and returns the encoded result combined from their
+// responses by s.
+func Call(ctx context.Context, backends []Backend, method string, params interface{}, s Strategy) (json.RawMessage, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("no backends")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type reply struct {
+		i int
+		r *Result
+	}
+	replies := make(chan reply, len(backends))
+	for i, b := range backends {
+		go func(i int, b Backend) {
+			res := &Result{Name: b.Name}
+			rsp, err := b.Client.Call(ctx, method, params)
+			if err != nil {
+				res.Err = &Error{Name: b.Name, Err: err}
+			} else {
+				res.Response = rsp
+			}
+			replies <- reply{i, res}
+		}(i, b)
+	}
+
+	results := make([]*Result, len(backends))
+	for range backends {
+		next := <-replies
+		results[next.i] = next.r
+		if s.Done(results) {
+			break
+		}
+	}
+	v, err := s.Combine(results)
+	if err != nil {
+		return nil, err
+	} else if raw, ok := v.(json.RawMessage); ok {
+		return raw, nil
+	}
+	return json.Marshal(v)
+}
+
+// CallResult invokes Call with the given arguments. If it succeeds, the result
+// is decoded into result.
+func CallResult(ctx context.Context, backends []Backend, method string, params interface{}, s Strategy, result interface{}) error {
+	raw, err := Call(ctx, backends, method, params, s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, result)
+}
+
+// FirstSuccess is a Strategy whose result is the result of the first backend
+// to reply successfully. If all the backends fail, the call reports all their
+// errors.
+var FirstSuccess Strategy = firstSuccess{}
+
+type firstSuccess struct{}
+
+func (firstSuccess) Done(results []*Result) bool { return firstOK(results) != nil }
+
+func (firstSuccess) Combine(results []*Result) (interface{}, error) {
+	if r := firstOK(results); r != nil {
+		return r.Response.RawResult(), nil
+	}
+	return nil, errorsOf(results)
+}
+
+// firstOK returns the first successful result, or nil.
+func firstOK(results []*Result) *Result {
+	for _, r := range results {
+		if r != nil && r.Err == nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// All is a Strategy that waits for all the backends to reply. Its result is an
+// array of their results, in the order of the backends. If any backend fails,
+// the call reports the errors of those that failed.
+var All Strategy = all{}
+
+type all struct{}
+
+func (all) Done(results []*Result) bool { return errorsOf(results) != nil }
+
+func (all) Combine(results []*Result) (interface{}, error) {
+	if err := errorsOf(results); err != nil {
+		return nil, err
+	}
+	out := make([]json.RawMessage, len(results))
+	for i, r := range results {
+		out[i] = r.Response.RawResult()
+	}
+	return out, nil
+}
+
+// Quorum returns a Strategy whose result is the first result reported by at
+// least n backends. Results are compared by their JSON encoding, ignoring
+// insignificant whitespace. If no result can reach a quorum, the call fails.
+// Quorum will panic if n < 1.
+func Quorum(n int) Strategy {
+	if n < 1 {
+		panic("fanout: quorum must be positive")
+	}
+	return quorum(n)
+}
+
+type quorum int
+
+func (q quorum) Done(results []*Result) bool {
+	votes, pending := q.count(results)
+	best := 0
+	for _, v := range votes {
+		if v.n > best {
+			best = v.n
+		}
+	}
+	return best >= int(q) || best+pending < int(q)
+}
+
+func (q quorum) Combine(results []*Result) (interface{}, error) {
+	votes, _ := q.count(results)
+	for _, v := range votes {
+		if v.n >= int(q) {
+			return v.result, nil
+		}
+	}
+	if err := errorsOf(results); err != nil {
+		return nil, fmt.Errorf("no quorum of %d: %w", int(q), err)
+	}
+	return nil, fmt.Errorf("no quorum of %d", int(q))
+}
+
+type vote struct {
+	result json.RawMessage
+	n      int
+}
+
+// count tallies the successful results by value, in order of first
+// appearance, and reports the number of results still pending.
+func (quorum) count(results []*Result) (votes []*vote, pending int) {
+	byValue := make(map[string]*vote)
+	for _, r := range results {
+		if r == nil {
+			pending++
+			continue
+		} else if r.Err != nil {
+			continue
+		}
+		raw := r.Response.RawResult()
+		var buf bytes.Buffer
+		key := string(raw)
+		if json.Compact(&buf, raw) == nil {
+			key = buf.String()
+		}
+		v, ok := byValue[key]
+		if !ok {
+			v = &vote{result: raw}
+			byValue[key] = v
+			votes = append(votes, v)
+		}
+		v.n++
+	}
+	return votes, pending
+}
+
+// Merge returns a Strategy that waits for all the backends to reply, and whose
+// result is computed by f from their results, in the order of the backends.
+// The results passed to f include those of backends that failed.
+func Merge(f func(results []*Result) (interface{}, error)) Strategy { return merge(f) }
+
+type merge func([]*Result) (interface{}, error)
+
+func (merge) Done([]*Result) bool { return false }
+
+func (m merge) Combine(results []*Result) (interface{}, error) { return m(results) }
@@ -0,0 +1,147 @@
+package fanout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/code"
+	"github.com/herenow/jrpc2/server"
+)
+
+// newBackends starts a local server for each of the given values. The "Get"
+// method of each server returns its value, or fails if the value is "". The
+// "Wait" method returns its value if it is not "", or else blocks until it is
+// cancelled and records the cancellation on the returned channel.
+func newBackends(t *testing.T, values ...string) ([]Backend, <-chan string, func()) {
+	t.Helper()
+	var backends []Backend
+	var cleanups []func()
+	cancelled := make(chan string, len(values))
+	for i, value := range values {
+		name, value := string(rune('a'+i)), value
+		cli, wait := server.Local(jrpc2.MapAssigner{
+			"Get": jrpc2.NewHandler(func(context.Context) (string, error) {
+				if value == "" {
+					return "", jrpc2.Errorf(code.Code(-29999), "no value")
+				}
+				return value, nil
+			}),
+			"Wait": jrpc2.NewHandler(func(ctx context.Context) (string, error) {
+				if value != "" {
+					return value, nil
+				}
+				<-ctx.Done()
+				cancelled <- name
+				return "", ctx.Err()
+			}),
+		}, nil)
+		backends = append(backends, Backend{Name: name, Client: cli})
+		cleanups = append(cleanups, func() { cli.Close(); wait() })
+	}
+	return backends, cancelled, func() {
+		for _, f := range cleanups {
+			f()
+		}
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	ctx := context.Background()
+	merged := Merge(func(results []*Result) (interface{}, error) {
+		var parts []string
+		for _, r := range results {
+			if r.Err != nil {
+				parts = append(parts, r.Name+"!")
+				continue
+			}
+			var s string
+			if err := r.Response.UnmarshalResult(&s); err != nil {
+				return nil, err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, "+"), nil
+	})
+	tests := []struct {
+		name     string
+		values   []string
+		strategy Strategy
+		want     string // encoded result, if no error is expected
+		errs     string // names of the failed backends, if an error is expected
+	}{
+		{"FirstSuccess", []string{"", "x", ""}, FirstSuccess, `"x"`, ""},
+		{"FirstSuccess/fail", []string{"", ""}, FirstSuccess, "", "a,b"},
+		{"All", []string{"x", "y", "z"}, All, `["x","y","z"]`, ""},
+		{"All/fail", []string{"x", "", "z"}, All, "", "b"},
+		{"Quorum", []string{"x", "y", "y"}, Quorum(2), `"y"`, ""},
+		{"Quorum/none", []string{"x", "y", "z"}, Quorum(2), "", ""},
+		{"Quorum/fail", []string{"x", "", ""}, Quorum(2), "", "b,c"},
+		{"Merge", []string{"x", "", "z"}, merged, `"x+b!+z"`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backends, _, cleanup := newBackends(t, test.values...)
+			defer cleanup()
+
+			got, err := Call(ctx, backends, "Get", nil, test.strategy)
+			if test.want != "" {
+				if err != nil {
+					t.Fatalf("Call: unexpected error: %v", err)
+				} else if string(got) != test.want {
+					t.Errorf("Call: got %#q, want %#q", got, test.want)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Call: got %#q, want error", got)
+			}
+			var errs Errors
+			errors.As(err, &errs)
+			var names []string
+			for _, e := range errs {
+				names = append(names, e.Name)
+				if code.FromError(e.Err) != -29999 {
+					t.Errorf("Backend %s: got error %v, want code -29999", e.Name, e.Err)
+				}
+			}
+			if got := strings.Join(names, ","); got != test.errs {
+				t.Errorf("Call: got errors from %q, want %q (%v)", got, test.errs, err)
+			}
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	// The first backend replies immediately; the others block until their
+	// calls are cancelled, which happens once the strategy is satisfied.
+	backends, cancelled, cleanup := newBackends(t, "x", "", "")
+	defer cleanup()
+
+	var got string
+	if err := CallResult(context.Background(), backends, "Wait", nil, FirstSuccess, &got); err != nil {
+		t.Fatalf("CallResult: unexpected error: %v", err)
+	} else if got != "x" {
+		t.Errorf("CallResult: got %q, want %q", got, "x")
+	}
+	names := []string{<-cancelled, <-cancelled}
+	if names[0] > names[1] {
+		names[0], names[1] = names[1], names[0]
+	}
+	if got := strings.Join(names, ","); got != "b,c" {
+		t.Errorf("Cancelled: got %q, want %q", got, "b,c")
+	}
+}
+
+func TestNoBackends(t *testing.T) {
+	if got, err := Call(context.Background(), nil, "Get", nil, All); err == nil {
+		t.Errorf("Call: got %#q, want error", got)
+	}
+	var v json.RawMessage
+	if err := CallResult(context.Background(), nil, "Get", nil, All, &v); err == nil {
+		t.Errorf("CallResult: got %#q, want error", v)
+	}
+}
@@ -0,0 +1,58 @@
+//go:build go1.18
+// +build go1.18
+
+package jrpc2
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/herenow/jrpc2/code"
+)
+
+func FuzzUnmarshalRequests(f *testing.F) {
+	for _, seed := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"X","params":[1,2]}`,
+		`{"jsonrpc":"2.0","method":"X","params":{"a":null}}`,
+		`{"jsonrpc":"2.0","id":null,"method":"X"}`,
+		`[{"jsonrpc":"2.0","id":"a","method":"X"},{"jsonrpc":"2.0","method":"Y"}]`,
+		`{"jsonrpc":"2.0","id":1,"method":"X","params":"bad"}`,
+		`[]`, `[1]`, `{}`, `null`, `[`, ``,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var reqs jrequests
+		if err := json.Unmarshal(data, &reqs); err != nil {
+			return
+		}
+		for i, req := range reqs {
+			if req.err != nil {
+				if code.FromError(req.err) != code.InvalidRequest {
+					t.Errorf("Request %d: got error %v, want code %v", i, req.err, code.InvalidRequest)
+				}
+				continue
+			}
+			if p := req.P; len(p) != 0 && p[0] != '[' && p[0] != '{' {
+				t.Errorf("Request %d: accepted invalid params %#q", i, string(p))
+			}
+		}
+
+		// A request that decodes successfully must survive re-encoding.
+		bits, err := json.Marshal(reqs)
+		if err != nil {
+			t.Fatalf("Marshal %+v: unexpected error: %v", reqs, err)
+		}
+		var again jrequests
+		if err := json.Unmarshal(bits, &again); err != nil {
+			t.Fatalf("Unmarshal %#q: unexpected error: %v", string(bits), err)
+		}
+		rebits, err := json.Marshal(again)
+		if err != nil {
+			t.Fatalf("Marshal %+v: unexpected error: %v", again, err)
+		} else if !reflect.DeepEqual(bits, rebits) {
+			t.Errorf("Round trip: got %#q, want %#q", string(rebits), string(bits))
+		}
+	})
+}
@@ -0,0 +1,285 @@
+// Package hedge implements hedged requests, which reduce the tail latency of
+// idempotent calls by racing a slow call against a duplicate.
+//
+// A Client issues calls through a set of *jrpc2.Client values connected to
+// equivalent servers. For the methods named as idempotent in its options, if
+// the first server has not answered within a delay derived from a percentile
+// of the recent latencies of the method, the client sends a duplicate request
+// to another server, and uses whichever response arrives first. The losing
+// call is cancelled, which sends an "rpc.cancel" notification to its server:
+//
+//    hc := hedge.New([]*jrpc2.Client{replicaA, replicaB}, &hedge.Options{
+//       Methods:    []string{"Get", "List"},
+//       Percentile: 0.95,
+//    })
+//    var result Item
+//    if err := hc.CallResult(ctx, "Get", params, &result); err != nil {
+//       log.Fatal(err)
+//    }
+//
+// Calls to other methods are sent to a single server, with no hedging.
+//
+// Hedging is provided by this wrapper rather than by an option in
+// jrpc2.ClientOptions, because a hedged call spans several connections while
+// a *jrpc2.Client owns exactly one. As an option, each client would have to
+// hold its peers and share their lifetimes. The Call and CallResult methods of
+// a *Client have the same signatures as those of a *jrpc2.Client, so code that
+// calls through an interface with those methods can use either.
+package hedge
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"bitbucket.org/creachadair/stringset"
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/metrics"
+)
+
+// Options control the behaviour of a Client. A nil *Options provides sensible
+// defaults, but hedges no methods.
+type Options struct {
+	// The names of the methods that are safe to hedge. Only calls to these
+	// methods are duplicated, so they should be idempotent.
+	Methods []string
+
+	// The percentile of the recent latencies of a method after which a call
+	// is hedged, between 0 and 1. If it is not in that range, 0.95 is used.
+	Percentile float64
+
+	// The number of recent latencies of each method from which the delay is
+	// computed. If this is less than 1, a default of 100 is used.
+	Window int
+
+	// The delay before hedging a call to a method, until its latency has been
+	// recorded for at least 10 calls. If this is zero, 100ms is used.
+	Delay time.Duration
+
+	// If set, record hedging here, as the counters "hedge.calls" (calls that
+	// may be hedged), "hedge.hedged" (calls for which a duplicate was sent),
+	// and "hedge.won" (calls answered first by the duplicate). The hedge rate
+	// is the ratio of hedge.hedged to hedge.calls.
+	Metrics *metrics.M
+}
+
+func (o *Options) methods() stringset.Set {
+	if o == nil {
+		return nil
+	}
+	return stringset.New(o.Methods...)
+}
+
+func (o *Options) percentile() float64 {
+	if o == nil || o.Percentile <= 0 || o.Percentile > 1 {
+		return 0.95
+	}
+	return o.Percentile
+}
+
+func (o *Options) window() int {
+	if o == nil || o.Window < 1 {
+		return 100
+	}
+	return o.Window
+}
+
+func (o *Options) delay() time.Duration {
+	if o == nil || o.Delay <= 0 {
+		return 100 * time.Millisecond
+	}
+	return o.Delay
+}
+
+func (o *Options) metrics() *metrics.M {
+	if o == nil {
+		return nil
+	}
+	return o.Metrics
+}
+
+// minSamples is the number of latencies of a method that must be recorded
+// before they determine the hedging delay.
+const minSamples = 10
+
+// A Client issues hedged calls through a set of clients. A *Client is safe for
+// concurrent use by multiple goroutines.
+type Client struct {
+	clients    []*jrpc2.Client
+	methods    stringset.Set
+	percentile float64
+	window     int
+	delay      time.Duration
+	metrics    *metrics.M
+
+	mu      sync.Mutex
+	next    int                   // index of the next client to call first
+	samples map[string]*latencies // recent latencies, by method
+}
+
+// New returns a Client that issues calls through the given clients, which
+// should be connected to servers that handle the same methods equivalently.
+// New will panic if len(clients) == 0.
+func New(clients []*jrpc2.Client, opts *Options) *Client {
+	if len(clients) == 0 {
+		panic("hedge: no clients")
+	}
+	return &Client{
+		clients:    clients,
+		methods:    opts.methods(),
+		percentile: opts.percentile(),
+		window:     opts.window(),
+		delay:      opts.delay(),
+		metrics:    opts.metrics(),
+		samples:    make(map[string]*latencies),
+	}
+}
+
+// Close closes all the clients of c, and reports the first error, if any.
+func (c *Client) Close() error {
+	var err error
+	for _, cli := range c.clients {
+		if cerr := cli.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Delay reports how long a call to method waits for a response before it is
+// hedged.
+func (c *Client) Delay(method string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.samples[method]; s != nil && len(s.d) >= minSamples {
+		return s.percentile(c.percentile)
+	}
+	return c.delay
+}
+
+// Call behaves as the Call method of a *jrpc2.Client. The clients of c take
+// turns to receive the first request of each call. If method is hedged and
+// the first request has not been answered within the delay for method, a
+// duplicate is sent to the next client, and the first successful response is
+// returned. If both requests fail, the error from the later is returned.
+func (c *Client) Call(ctx context.Context, method string, params interface{}) (*jrpc2.Response, error) {
+	first := c.pick()
+	if !c.methods.Contains(method) || len(c.clients) == 1 {
+		return c.clients[first].Call(ctx, method, params)
+	}
+	c.count("hedge.calls")
+
+	type reply struct {
+		rsp   *jrpc2.Response
+		err   error
+		hedge bool
+	}
+	replies := make(chan reply, 2)
+	start := time.Now()
+	launch := func(i int, hedge bool) context.CancelFunc {
+		cctx, cancel := context.WithCancel(ctx)
+		go func() {
+			rsp, err := c.clients[i].Call(cctx, method, params)
+			if err == nil {
+				// Record every successful request, including one that loses
+				// the race, and measure from the start of the call so that a
+				// winning duplicate does not report only its own time.
+				c.record(method, time.Since(start))
+			}
+			replies <- reply{rsp: rsp, err: err, hedge: hedge}
+		}()
+		return cancel
+	}
+
+	// Cancelling the context of the losing call sends rpc.cancel to its server.
+	defer launch(first, false)()
+	timer := time.NewTimer(c.Delay(method))
+	defer timer.Stop()
+
+	hedged, pending := false, 1
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			c.count("hedge.hedged")
+			defer launch((first+1)%len(c.clients), true)()
+			hedged = true
+			pending++
+
+		case r := <-replies:
+			pending--
+			if r.err == nil {
+				if r.hedge {
+					c.count("hedge.won")
+				}
+				return r.rsp, nil
+			} else if !hedged {
+				return nil, r.err // do not hedge a call that has already failed
+			}
+			err = r.err
+		}
+	}
+	return nil, err
+}
+
+// CallResult invokes Call with the given method and params. If it succeeds,
+// the result is decoded into result.
+func (c *Client) CallResult(ctx context.Context, method string, params, result interface{}) error {
+	rsp, err := c.Call(ctx, method, params)
+	if err != nil {
+		return err
+	}
+	return rsp.UnmarshalResult(result)
+}
+
+// pick returns the index of the client to receive the first request of a call.
+func (c *Client) pick() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.next
+	c.next = (c.next + 1) % len(c.clients)
+	return i
+}
+
+// record adds the latency of a successful call to method.
+func (c *Client) record(method string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.samples[method]
+	if s == nil {
+		s = &latencies{max: c.window}
+		c.samples[method] = s
+	}
+	s.add(d)
+}
+
+func (c *Client) count(name string) {
+	if c.metrics != nil {
+		c.metrics.Count(name, 1)
+	}
+}
+
+// latencies is a ring buffer of recent call latencies.
+type latencies struct {
+	d   []time.Duration
+	pos int // the next position to replace, once d is full
+	max int
+}
+
+func (s *latencies) add(d time.Duration) {
+	if len(s.d) < s.max {
+		s.d = append(s.d, d)
+		return
+	}
+	s.d[s.pos] = d
+	s.pos = (s.pos + 1) % s.max
+}
+
+// percentile returns the p-th percentile of the latencies, for 0 < p ≤ 1.
+func (s *latencies) percentile(p float64) time.Duration {
+	sorted := make([]time.Duration, len(s.d))
+	copy(sorted, s.d)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))]
+}
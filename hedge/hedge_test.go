@@ -0,0 +1,113 @@
+package hedge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/metrics"
+	"github.com/herenow/jrpc2/server"
+)
+
+// newReplica starts a local server whose Read and Write methods return name
+// after the given delay. It reports cancelled calls on the returned channel.
+func newReplica(t *testing.T, name string, delay time.Duration) (*jrpc2.Client, <-chan string, func() error) {
+	t.Helper()
+	cancelled := make(chan string, 10)
+	h := jrpc2.NewHandler(func(ctx context.Context, req *jrpc2.Request) (string, error) {
+		select {
+		case <-time.After(delay):
+			return name, nil
+		case <-ctx.Done():
+			cancelled <- req.Method()
+			return "", ctx.Err()
+		}
+	})
+	cli, wait := server.Local(jrpc2.MapAssigner{"Read": h, "Write": h}, nil)
+	return cli, cancelled, wait
+}
+
+func TestHedge(t *testing.T) {
+	slow, slowCancelled, waitSlow := newReplica(t, "slow", time.Minute)
+	fast, _, waitFast := newReplica(t, "fast", 0)
+	defer waitSlow()
+	defer waitFast()
+
+	m := metrics.New()
+	hc := New([]*jrpc2.Client{slow, fast}, &Options{
+		Methods: []string{"Read"},
+		Delay:   10 * time.Millisecond,
+		Metrics: m,
+	})
+	defer hc.Close()
+	ctx := context.Background()
+
+	// The first call goes to the slow replica, and is hedged to the fast one,
+	// which wins; the slow call is cancelled.
+	var got string
+	if err := hc.CallResult(ctx, "Read", nil, &got); err != nil {
+		t.Fatalf("Read: unexpected error: %v", err)
+	} else if got != "fast" {
+		t.Errorf("Read: got %q, want %q", got, "fast")
+	}
+	// Its latency is measured from the start of the call, so it includes the
+	// delay before the duplicate was sent.
+	hc.mu.Lock()
+	if d := hc.samples["Read"].d; len(d) != 1 || d[0] < 10*time.Millisecond {
+		t.Errorf("Latencies: got %v, want one of at least 10ms", d)
+	}
+	hc.mu.Unlock()
+	select {
+	case method := <-slowCancelled:
+		if method != "Read" {
+			t.Errorf("Cancelled: got %q, want Read", method)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Read on the slow replica was not cancelled")
+	}
+
+	// The second call goes to the fast replica, and is answered before the
+	// delay.
+	if err := hc.CallResult(ctx, "Read", nil, &got); err != nil {
+		t.Fatalf("Read: unexpected error: %v", err)
+	} else if got != "fast" {
+		t.Errorf("Read: got %q, want %q", got, "fast")
+	}
+
+	// A method that is not idempotent is not hedged.
+	wctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := hc.CallResult(wctx, "Write", nil, &got); err != context.DeadlineExceeded {
+		t.Errorf("Write: got (%q, %v), want %v", got, err, context.DeadlineExceeded)
+	}
+
+	counts := make(map[string]int64)
+	m.Snapshot(metrics.Snapshot{Counter: counts})
+	want := map[string]int64{"hedge.calls": 2, "hedge.hedged": 1, "hedge.won": 1}
+	for name, n := range want {
+		if counts[name] != n {
+			t.Errorf("Counter %q: got %d, want %d", name, counts[name], n)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	cli, _, wait := newReplica(t, "only", 0)
+	defer wait()
+	hc := New([]*jrpc2.Client{cli}, &Options{Methods: []string{"Read"}, Window: 20, Delay: time.Second})
+	defer hc.Close()
+
+	// Until enough latencies are recorded, the configured delay is used.
+	if got := hc.Delay("Read"); got != time.Second {
+		t.Errorf("Delay: got %v, want %v", got, time.Second)
+	}
+	for i := 1; i <= 40; i++ {
+		hc.record("Read", time.Duration(i)*time.Millisecond)
+	}
+	// The window holds the latest 20 latencies, 21ms–40ms, whose 95th
+	// percentile (by the nearest rank below) is 39ms.
+	if got, want := hc.Delay("Read"), 39*time.Millisecond; got != want {
+		t.Errorf("Delay: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,44 @@
+// Package canon implements a canonical encoding for JSON values, so that values
+// differing only in the order of object keys, in insignificant whitespace, or
+// in the escapes used in strings have the same encoding.
+package canon
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Decode returns the generic representation of the JSON value in data. Numbers
+// are decoded as json.Number, to preserve their precision.
+func Decode(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// encode returns the canonical encoding of v, which should be a value returned
+// by Decode. Object keys are sorted, there is no insignificant whitespace, and
+// HTML characters are not escaped.
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// JSON returns the canonical encoding of the JSON value in data. It reports an
+// error if data is not valid JSON.
+func JSON(data []byte) ([]byte, error) {
+	v, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return encode(v)
+}
@@ -0,0 +1,25 @@
+package canon
+
+import "testing"
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{`17`, `17`},
+		{` "<a&b>" `, `"<a&b>"`},
+		{`{"b": [1, 2.50], "a": null}`, `{"a":null,"b":[1,2.50]}`},
+		{`12345678901234567890123`, `12345678901234567890123`},
+	}
+	for _, test := range tests {
+		got, err := JSON([]byte(test.input))
+		if err != nil {
+			t.Errorf("JSON(%#q): unexpected error: %v", test.input, err)
+		} else if string(got) != test.want {
+			t.Errorf("JSON(%#q): got %#q, want %#q", test.input, got, test.want)
+		}
+	}
+	if got, err := JSON([]byte(`{bogus`)); err == nil {
+		t.Errorf("JSON(bogus): got %#q, want error", got)
+	}
+}
@@ -7,9 +7,13 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -31,6 +35,10 @@ var (
 	doSeq       = flag.Bool("seq", false, "Issue calls sequentially rather than as a batch")
 	withLogging = flag.Bool("v", false, "Enable verbose logging")
 	withMeta    = flag.String("meta", "", "Attach this JSON value as request metadata (implies -c)")
+	useTLS      = flag.Bool("tls", false, "Connect to the server using TLS")
+	tlsCert     = flag.String("cert", "", "Client certificate file for TLS (PEM, implies -tls)")
+	tlsKey      = flag.String("key", "", "Client private key file for TLS (PEM)")
+	tlsCA       = flag.String("ca", "", "CA certificates to verify the server (PEM, implies -tls)")
 )
 
 func init() {
@@ -59,6 +67,9 @@ func main() {
 	if nc == nil {
 		log.Fatalf("Unknown channel framing %q", *chanFraming)
 	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("The -cert and -key flags must be used together")
+	}
 	ctx := context.Background()
 	if *withMeta != "" {
 		mc, err := jctx.WithMetadata(ctx, json.RawMessage(*withMeta))
@@ -74,7 +85,7 @@ func main() {
 	if !strings.Contains(addr, ":") {
 		ntype = "unix"
 	}
-	conn, err := net.DialTimeout(ntype, addr, *dialTimeout)
+	conn, err := dial(ntype, addr)
 	if err != nil {
 		log.Fatalf("Dial %q: %v", addr, err)
 	}
@@ -118,6 +129,35 @@ func main() {
 	}
 }
 
+// dial connects to the server at addr, using TLS if it was requested.
+func dial(ntype, addr string) (net.Conn, error) {
+	if !*useTLS && *tlsCert == "" && *tlsCA == "" {
+		return net.DialTimeout(ntype, addr, *dialTimeout)
+	}
+	cfg := new(tls.Config)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		cfg.ServerName = host
+	}
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid CA certificates found")
+		}
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: *dialTimeout}, ntype, addr, cfg)
+}
+
 func issueCalls(ctx context.Context, cli *jrpc2.Client, args []string) ([]*jrpc2.Response, error) {
 	specs := newSpecs(args)
 	if *doSeq {
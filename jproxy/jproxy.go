@@ -4,8 +4,13 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -13,12 +18,16 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/herenow/jrpc2"
 	"github.com/herenow/jrpc2/channel"
 	"github.com/herenow/jrpc2/channel/chanutil"
+	"github.com/herenow/jrpc2/jctx"
+	"github.com/herenow/jrpc2/metrics"
 	"github.com/herenow/jrpc2/proxy"
 	"github.com/herenow/jrpc2/server"
+	"github.com/herenow/jrpc2/supervisor"
 )
 
 var (
@@ -28,6 +37,19 @@ var (
 	doPipe        = flag.Bool("pipe", false, "Communicate with stdin/stdout")
 	doStderr      = flag.Bool("stderr", false, "Send subprocess stderr to proxy stderr")
 	doVerbose     = flag.Bool("v", false, "Enable verbose logging")
+	drainTimeout  = flag.Duration("drain", 5*time.Second, "Time allowed for active calls to finish at shutdown")
+	useTLS        = flag.Bool("tls", false, "Require clients to connect using TLS")
+	tlsCert       = flag.String("cert", "", "Server certificate file for TLS (PEM, implies -tls)")
+	tlsKey        = flag.String("key", "", "Server private key file for TLS (PEM)")
+	tlsCA         = flag.String("ca", "", "If set, require client certificates signed by these CAs (PEM, implies -tls)")
+	notifyMode    = flag.String("notify", "", `Relay server notifications to clients ("broadcast" or "route")`)
+	namesTTL      = flag.Duration("names-ttl", time.Minute, "How long to cache the method names reported by the server")
+	mergeMetrics  = flag.Bool("metrics", false, `Include server metrics in rpc.serverInfo, prefixed by "backend."`)
+	configFile    = flag.String("config", "", "Read routes and method rules from this JSON file")
+	allowMethods  = flag.String("allow", "", "If set, only forward methods matching these comma-separated globs")
+	denyMethods   = flag.String("deny", "", "Do not forward methods matching these comma-separated globs")
+	clientContext = flag.Bool("cctx", false, "Decode request contexts (deadline, metadata) sent by clients")
+	serverContext = flag.Bool("sctx", false, "Encode request contexts (deadline, metadata) sent to the server")
 
 	logger *log.Logger
 )
@@ -40,8 +62,44 @@ Start the specified command in a subprocess and connect a JSON-RPC client to
 its stdin and stdout. Listen at the given address, and reverse proxy clients
 that connect to it via the client to the subprocess.
 
-If the subprocess exits or the proxy receives an interrupt (SIGINT), the
-process cleans up any remaining clients and exits.
+Alternatively, with -config, route each request to one of several servers
+according to its method name. The config file is a JSON object like:
+
+  {"routes": [
+    {"prefix": "Math.", "address": "localhost:8081", "strip": true},
+    {"pattern": "Store.*", "address": "/tmp/store.sock", "timeout": "5s"},
+    {"prefix": "Log.", "command": ["logserver", "-v"], "framing": "line"}
+  ]}
+
+Each route names its server by "address" (TCP if it contains a colon, else a
+Unix socket) or by "command" (run as a subprocess). The routes are tried in
+order, and a request is sent to the server of the first route whose "prefix"
+and "pattern" (a glob) match its method name. A route may also set "framing"
+(default -sf), "timeout" for calls, "strip" to remove the prefix from the
+method name, and "addPrefix" to add a prefix to the method name.
+
+The config file may also restrict and modify the requests clients send, with
+or without routes:
+
+  {"allow":  ["Math.*", "Store.Get"],
+   "deny":   ["*.Debug"],
+   "rename": {"Get": "Store.Get"},
+   "inject": [{"pattern": "Store.*", "params": {"tenant": "acme"}}]}
+
+Methods not allowed, or denied, are rejected with a "method not found" error.
+The -allow and -deny flags add to the lists in the config file. Patterns have
+the syntax of Go's path.Match, in which "*" does not match "/", and the proxy
+does not start if any pattern is malformed.
+
+By default, the proxy forwards request parameters unmodified. If clients
+wrap their parameters with a context (see package jctx), set -cctx so that
+the proxy honours their deadlines. If the server expects a context wrapper,
+set -sctx so that the proxy sends its deadlines. With both set, the deadline
+and metadata of each request are propagated from the client to the server.
+Cancellations are propagated in any case.
+
+If a server exits or the proxy receives an interrupt (SIGINT), the process
+cleans up any remaining clients and exits.
 
 Options:
 `, filepath.Base(os.Args[0]))
@@ -51,14 +109,33 @@ Options:
 
 func main() {
 	flag.Parse()
-	if *doPipe != (flag.NArg() == 0) {
+	cfg := new(config)
+	if *configFile != "" {
+		var err error
+		if cfg, err = readConfig(*configFile); err != nil {
+			log.Fatalf("Reading config: %v", err)
+		}
+	}
+	if len(cfg.Routes) != 0 {
+		if *doPipe || flag.NArg() != 0 {
+			log.Fatal("You may not combine config routes with -pipe or a command")
+		} else if *notifyMode != "" {
+			log.Fatal("You may not combine config routes with -notify")
+		}
+	} else if *doPipe != (flag.NArg() == 0) {
 		log.Fatal("You must provide a command to execute or set -pipe")
-	} else if *address == "" {
+	}
+	if *address == "" {
 		log.Fatal("You must provide an -address to listen on")
 	}
 	if *doVerbose {
 		logger = log.New(os.Stderr, "[proxy] ", log.LstdFlags|log.Lshortfile)
 	}
+	if (*useTLS || *tlsCA != "") && (*tlsCert == "" || *tlsKey == "") {
+		log.Fatal("You must provide a -cert and -key to use TLS")
+	} else if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("The -cert and -key flags must be used together")
+	}
 
 	cframe := chanutil.Framing(*clientFraming)
 	if cframe == nil {
@@ -68,12 +145,21 @@ func main() {
 	if sframe == nil {
 		log.Fatalf("Unknown server channel framing %q", *serverFraming)
 	}
-	if err := run(context.Background(), cframe, sframe); err != nil {
+	if _, ok := notifyModes[*notifyMode]; !ok {
+		log.Fatalf("Unknown notification mode %q", *notifyMode)
+	}
+	if *allowMethods != "" {
+		cfg.Allow = append(cfg.Allow, strings.Split(*allowMethods, ",")...)
+	}
+	if *denyMethods != "" {
+		cfg.Deny = append(cfg.Deny, strings.Split(*denyMethods, ",")...)
+	}
+	if err := run(context.Background(), cfg, cframe, sframe); err != nil {
 		log.Fatalf("Error: %v", err)
 	}
 }
 
-func run(ctx context.Context, cframe, sframe channel.Framing) error {
+func run(ctx context.Context, cfg *config, cframe, sframe channel.Framing) error {
 	ctx, cancel := context.WithCancel(ctx)
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
@@ -83,13 +169,46 @@ func run(ctx context.Context, cframe, sframe channel.Framing) error {
 		signal.Stop(sig)
 	}()
 
-	ch, err := start(ctx, sframe)
-	if err != nil {
-		return err
+	mode := notifyModes[*notifyMode]
+	popts := &proxy.Options{
+		Notify:   mode,
+		NamesTTL: *namesTTL,
+		Allow:    cfg.Allow,
+		Deny:     cfg.Deny,
+		Rename:   cfg.Rename,
+	}
+	for _, inj := range cfg.Inject {
+		popts.Inject = append(popts.Inject, proxy.Injection{
+			Pattern: inj.Pattern,
+			Params:  inj.Params,
+		})
+	}
+	m := metrics.New()
+	if *mergeMetrics {
+		popts.Metrics = m
+	}
+	defer stopChildren()
+	var pc assigner
+	if len(cfg.Routes) != 0 {
+		rules, err := connectRoutes(cfg, sframe, cancel)
+		if err != nil {
+			return err
+		}
+		if pc, err = proxy.NewRouter(rules, popts); err != nil {
+			return err
+		}
+	} else {
+		var ch channel.Channel
+		var err error
+		if *doPipe {
+			ch = sframe(os.Stdin, os.Stdout)
+		} else if ch, err = startCommand(flag.Args(), sframe); err != nil {
+			return err
+		}
+		if pc, err = proxy.NewClient(channel.WithTrigger(ch, cancel), clientOptions(), popts); err != nil {
+			return err
+		}
 	}
-	pc := proxy.New(jrpc2.NewClient(channel.WithTrigger(ch, cancel), &jrpc2.ClientOptions{
-		Logger: logger,
-	}))
 	defer pc.Close()
 
 	kind, addr := "tcp", *address
@@ -100,44 +219,194 @@ func run(ctx context.Context, cframe, sframe channel.Framing) error {
 	if err != nil {
 		return fmt.Errorf("Listen %s %q: %v", kind, addr, err)
 	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return err
+	}
+	sopts := &jrpc2.ServerOptions{
+		Concurrency: 8,
+		AllowPush:   mode != proxy.Discard,
+		Metrics:     m,
+		Logger:      logger,
+	}
+	if *clientContext {
+		sopts.DecodeContext = jctx.Decode
+	}
+	srv := server.New(lst, pc, &server.LoopOptions{
+		Framing:       cframe,
+		TLSConfig:     tlsConfig,
+		ServerOptions: sopts,
+	})
 	go func() {
 		<-ctx.Done()
-		lst.Close()
+
+		// Give calls in progress a chance to finish before exiting.
+		sctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
 	}()
+	return srv.Serve()
+}
 
-	server.Loop(lst, pc, &server.LoopOptions{
-		Framing: cframe,
-		ServerOptions: &jrpc2.ServerOptions{
-			Concurrency:    8,
-			DisableBuiltin: true,
-			Logger:         logger,
-		},
-	})
-	return nil
+// clientOptions returns the options for clients connected to the servers.
+func clientOptions() *jrpc2.ClientOptions {
+	opts := &jrpc2.ClientOptions{Logger: logger}
+	if *serverContext {
+		opts.EncodeContext = jctx.Encode
+	}
+	return opts
+}
+
+// An assigner is a proxy that can be closed.
+type assigner interface {
+	jrpc2.Assigner
+	Close() error
+}
+
+var notifyModes = map[string]proxy.NotifyMode{
+	"":          proxy.Discard,
+	"broadcast": proxy.Broadcast,
+	"route":     proxy.Route,
 }
 
-func start(ctx context.Context, framing channel.Framing) (channel.Channel, error) {
-	if *doPipe {
-		return framing(os.Stdin, os.Stdout), nil
+// newTLSConfig returns the TLS configuration for the proxy listener, or nil if
+// TLS was not requested.
+func newTLSConfig() (*tls.Config, error) {
+	if *tlsCert == "" {
+		return nil, nil
 	}
-	// Start the subprocess and connect its stdin and stdout to a client.
-	proc := exec.CommandContext(ctx, flag.Arg(0), flag.Args()[1:]...)
-	in, err := proc.StdinPipe()
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
 	if err != nil {
-		return nil, fmt.Errorf("connecting to stdin: %v", err)
+		return nil, fmt.Errorf("loading server certificate: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid CA certificates found")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-	out, err := proc.StdoutPipe()
+	return cfg, nil
+}
+
+// A config is the format of the -config file.
+type config struct {
+	Allow  []string          `json:"allow"`
+	Deny   []string          `json:"deny"`
+	Rename map[string]string `json:"rename"`
+	Inject []struct {
+		Pattern string                 `json:"pattern"`
+		Params  map[string]interface{} `json:"params"`
+	} `json:"inject"`
+
+	Routes []struct {
+		Prefix    string   `json:"prefix"`
+		Pattern   string   `json:"pattern"`
+		Address   string   `json:"address"`
+		Command   []string `json:"command"`
+		Framing   string   `json:"framing"`
+		Timeout   string   `json:"timeout"`
+		Strip     bool     `json:"strip"`
+		AddPrefix string   `json:"addPrefix"`
+	} `json:"routes"`
+}
+
+// readConfig reads and parses the config file at path.
+func readConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("connecting to stdout: %v", err)
+		return nil, err
+	}
+	cfg := new(config)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// connectRoutes connects to the servers named by the routes of cfg. The
+// servers use the given framing unless the config overrides it. If any server
+// connection closes, cancel is called.
+func connectRoutes(cfg *config, framing channel.Framing, cancel func()) ([]proxy.Rule, error) {
+	var rules []proxy.Rule
+	for i, route := range cfg.Routes {
+		rule := proxy.Rule{
+			Prefix:      route.Prefix,
+			Pattern:     route.Pattern,
+			StripPrefix: route.Strip,
+			AddPrefix:   route.AddPrefix,
+		}
+		if route.Timeout != "" {
+			var err error
+			rule.Timeout, err = time.ParseDuration(route.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: invalid timeout: %v", i+1, err)
+			}
+		}
+		frame := framing
+		if route.Framing != "" {
+			if frame = chanutil.Framing(route.Framing); frame == nil {
+				return nil, fmt.Errorf("route %d: unknown framing %q", i+1, route.Framing)
+			}
+		}
+		var ch channel.Channel
+		switch {
+		case (route.Address == "") == (len(route.Command) == 0):
+			return nil, fmt.Errorf("route %d: exactly one of address or command is required", i+1)
+		case route.Address != "":
+			kind := "tcp"
+			if !strings.Contains(route.Address, ":") {
+				kind = "unix"
+			}
+			conn, err := net.Dial(kind, route.Address)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: dial %s %q: %v", i+1, kind, route.Address, err)
+			}
+			ch = frame(conn, conn)
+		default:
+			var err error
+			if ch, err = startCommand(route.Command, frame); err != nil {
+				return nil, fmt.Errorf("route %d: %v", i+1, err)
+			}
+		}
+		rule.Client = jrpc2.NewClient(channel.WithTrigger(ch, cancel), clientOptions())
+		rules = append(rules, rule)
 	}
+	return rules, nil
+}
+
+// children are the server subprocesses started by the proxy, which are
+// terminated when it exits.
+var children []*supervisor.Process
+
+// startCommand starts a subprocess running args, and returns a channel
+// connected to its stdin and stdout.
+func startCommand(args []string, framing channel.Framing) (channel.Channel, error) {
+	opts := &supervisor.Options{Framing: framing, StopTimeout: *drainTimeout}
 	if *doStderr {
-		proc.Stderr = os.Stderr
+		opts.Logger = log.New(os.Stderr, "", 0)
 	}
-	if err := proc.Start(); err != nil {
+	proc, err := supervisor.StartProcess(exec.Command(args[0], args[1:]...), opts)
+	if err != nil {
 		return nil, fmt.Errorf("starting server failed: %v", err)
 	}
+	children = append(children, proc)
 	go func() {
-		log.Printf("Subprocess exited: %v", proc.Wait())
+		log.Printf("Subprocess %q exited: %v", args[0], proc.Wait())
 	}()
-	return framing(out, in), nil
+	return proc.Channel(), nil
+}
+
+// stopChildren terminates the subprocesses started by startCommand.
+func stopChildren() {
+	for _, proc := range children {
+		proc.Close()
+	}
 }
@@ -0,0 +1,149 @@
+// Program jreplay replays a recording of JSON-RPC traffic made with the
+// replay package.
+//
+// Usage:
+//    jreplay [options] <recording> <address>
+//
+// By default, jreplay connects to the server at address, sends it the
+// requests from the recording, and reports whether its responses match those
+// in the recording. With -serve, jreplay instead listens at address and acts
+// as a fake server, answering each client with the recorded responses.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/herenow/jrpc2/channel"
+	"github.com/herenow/jrpc2/channel/chanutil"
+	"github.com/herenow/jrpc2/replay"
+)
+
+var (
+	dialTimeout = flag.Duration("dial", 5*time.Second, "Timeout on dialing the server (0 for no timeout)")
+	waitTimeout = flag.Duration("timeout", 30*time.Second, "Timeout for receiving all responses (0 for no timeout)")
+	chanFraming = flag.String("f", "raw", `Channel framing ("json", "line", "lsp", "raw", "varint")`)
+	doServe     = flag.Bool("serve", false, "Listen at the address and serve recorded responses")
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s [options] <recording> <address>
+
+Replay the JSON-RPC requests in a recording to the server at the specified
+address, and report whether its responses match the recorded responses.  With
+-serve, listen at the address and answer clients with the recorded responses.
+
+Options:
+`, filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 {
+		log.Fatal("Arguments are <recording> <address>")
+	}
+	nc := chanutil.Framing(*chanFraming)
+	if nc == nil {
+		log.Fatalf("Unknown channel framing %q", *chanFraming)
+	}
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Opening recording: %v", err)
+	}
+	entries, err := replay.Load(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Loading recording: %v", err)
+	}
+	ntype, addr := "tcp", flag.Arg(1)
+	if !strings.Contains(addr, ":") {
+		ntype = "unix"
+	}
+
+	if *doServe {
+		lst, err := net.Listen(ntype, addr)
+		if err != nil {
+			log.Fatalf("Listen %q: %v", addr, err)
+		}
+		log.Printf("Serving %d recorded messages at %q...", len(entries), addr)
+		if err := serve(lst, nc, entries); err != nil {
+			log.Fatalf("Serve: %v", err)
+		}
+		return
+	}
+
+	conn, err := net.DialTimeout(ntype, addr, *dialTimeout)
+	if err != nil {
+		log.Fatalf("Dial %q: %v", addr, err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	if *waitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *waitTimeout)
+		defer cancel()
+	}
+	if err := replay.Check(ctx, nc(conn, conn), entries); err != nil {
+		if cerr, ok := err.(*replay.CheckError); ok {
+			for _, m := range cerr.Mismatches {
+				fmt.Printf("MISMATCH id=%s\n  got:  %s\n  want: %s\n", m.ID, m.Got, m.Want)
+			}
+			log.Fatalf("%d responses did not match the recording", len(cerr.Mismatches))
+		}
+		log.Fatalf("Check failed: %v", err)
+	}
+	log.Printf("All responses match the recording")
+}
+
+// serve accepts connections from lst and answers each with a fake server
+// backed by the recorded entries.
+func serve(lst net.Listener, nc channel.Framing, entries []*replay.Entry) error {
+	for {
+		conn, err := lst.Accept()
+		if err != nil {
+			if channel.IsErrClosing(err) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			ch := nc(conn, conn)
+			fake := replay.NewFake(entries)
+			defer fake.Close()
+
+			// Copy responses from the fake to the client.
+			go func() {
+				for {
+					msg, err := fake.Recv()
+					if err != nil {
+						return
+					} else if err := ch.Send(msg); err != nil {
+						log.Printf("Send to %v: %v", conn.RemoteAddr(), err)
+						return
+					}
+				}
+			}()
+
+			// Copy requests from the client to the fake.
+			for {
+				msg, err := ch.Recv()
+				if err != nil {
+					return
+				} else if err := fake.Send(msg); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
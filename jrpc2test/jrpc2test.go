@@ -0,0 +1,258 @@
+// Package jrpc2test provides support for testing code that uses a
+// *jrpc2.Client, by serving it from a mock instead of a real server.
+//
+// A Mock is a jrpc2.Assigner whose behaviour is set by declaring the calls it
+// expects to receive, and what each should return:
+//
+//    m := jrpc2test.NewMock()
+//    m.Expect("Math.Add").WithParams(jrpc2test.Params([]int{1, 2})).Return(3)
+//    m.Expect("Math.Div").ReturnError(jrpc2.Errorf(code.InvalidParams, "divide by zero"))
+//
+//    cli, wait := server.Local(m, nil)
+//    ... exercise code that uses cli ...
+//    cli.Close()
+//    wait()
+//
+//    m.Check(t)  // report unmet expectations and unexpected calls
+//
+// A call that does not match any expectation fails with code.MethodNotFound,
+// and is reported by Verify and Check.
+package jrpc2test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/code"
+	"github.com/herenow/jrpc2/internal/canon"
+)
+
+// A Matcher reports whether the encoded parameters of a request are
+// acceptable. The params are nil if the request had no parameters.
+type Matcher func(params json.RawMessage) bool
+
+// Params returns a Matcher that accepts parameters equal to the JSON encoding
+// of v, ignoring the order of object keys and whitespace. If v == nil, the
+// matcher accepts only requests without parameters.
+func Params(v interface{}) Matcher {
+	if v == nil {
+		return func(params json.RawMessage) bool { return len(params) == 0 }
+	}
+	bits, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("jrpc2test: invalid parameter value: %v", err))
+	}
+	want, err := canon.JSON(bits)
+	if err != nil {
+		panic(fmt.Sprintf("jrpc2test: invalid parameter value: %v", err))
+	}
+	return func(params json.RawMessage) bool {
+		got, err := canon.JSON(params)
+		return err == nil && bytes.Equal(got, want)
+	}
+}
+
+// ParamsFunc returns a Matcher that decodes the parameters into a new value
+// of the same type as v, and calls match with the result.  If decoding fails,
+// the parameters are rejected. For example:
+//
+//    m.Expect("Lookup").WithParams(jrpc2test.ParamsFunc(func(req *Request) bool {
+//       return strings.HasPrefix(req.Name, "test")
+//    })).Return(true)
+//
+// ParamsFunc will panic if match is not a function of one argument returning
+// bool.
+func ParamsFunc(match interface{}) Matcher {
+	fn := reflect.ValueOf(match)
+	typ := fn.Type()
+	if typ.Kind() != reflect.Func || typ.NumIn() != 1 || typ.NumOut() != 1 || typ.Out(0).Kind() != reflect.Bool {
+		panic("jrpc2test: matcher must have type func(T) bool")
+	}
+	return func(params json.RawMessage) bool {
+		arg := reflect.New(typ.In(0))
+		if err := json.Unmarshal(params, arg.Interface()); err != nil {
+			return false
+		}
+		return fn.Call([]reflect.Value{arg.Elem()})[0].Bool()
+	}
+}
+
+// A Mock is a jrpc2.Assigner that answers calls according to a set of
+// expectations. A *Mock is safe for concurrent use by multiple goroutines.
+type Mock struct {
+	mu         sync.Mutex
+	exps       []*Expectation
+	unexpected []*Call
+}
+
+// NewMock constructs a new Mock with no expectations.
+func NewMock() *Mock { return new(Mock) }
+
+// A Call records a request received by a Mock.
+type Call struct {
+	Method string
+	Params json.RawMessage
+}
+
+func (c *Call) String() string {
+	if len(c.Params) == 0 {
+		return c.Method
+	}
+	return c.Method + " " + string(c.Params)
+}
+
+// Expect adds and returns a new expectation for a call to the named method.
+// By default, the expectation matches any parameters, must be met at least
+// once, and returns a null result. When several expectations match a call,
+// the first one declared that has not been exhausted is used.
+func (m *Mock) Expect(method string) *Expectation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := &Expectation{method: method}
+	m.exps = append(m.exps, e)
+	return e
+}
+
+// An Expectation describes a call expected by a Mock, and its result. The
+// methods of an Expectation return their receiver to permit chaining. They
+// should be called before the mock is used.
+type Expectation struct {
+	method string
+	match  Matcher
+	result interface{}
+	err    error
+	times  int // the number of calls expected, or 0 for at least one
+	calls  int // the number of calls received
+}
+
+// WithParams restricts e to calls whose parameters are accepted by match.
+func (e *Expectation) WithParams(match Matcher) *Expectation { e.match = match; return e }
+
+// Return sets the result returned by calls matching e.
+func (e *Expectation) Return(v interface{}) *Expectation { e.result = v; return e }
+
+// ReturnError sets the error returned by calls matching e. If err is a
+// *jrpc2.Error, the client receives its code and message verbatim.
+func (e *Expectation) ReturnError(err error) *Expectation { e.err = err; return e }
+
+// Times sets the exact number of calls expected to match e. Once e has been
+// matched n times, it no longer matches further calls.
+func (e *Expectation) Times(n int) *Expectation { e.times = n; return e }
+
+func (e *Expectation) String() string { return e.method }
+
+// matches reports whether e accepts a call of method with params. The caller
+// must hold the lock on the mock.
+func (e *Expectation) matches(method string, params json.RawMessage) bool {
+	if e.method != method || (e.times > 0 && e.calls >= e.times) {
+		return false
+	}
+	return e.match == nil || e.match(params)
+}
+
+// met reports whether e has been satisfied.
+func (e *Expectation) met() bool {
+	if e.times > 0 {
+		return e.calls == e.times
+	}
+	return e.calls > 0
+}
+
+// Assign implements part of the jrpc2.Assigner interface. Every method is
+// assigned to a handler, so that unexpected calls can be recorded.
+func (m *Mock) Assign(method string) jrpc2.Handler { return handler{m} }
+
+// Names implements part of the jrpc2.Assigner interface. It returns the names
+// of the methods having expectations.
+func (m *Mock) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range m.exps {
+		if !seen[e.method] {
+			seen[e.method] = true
+			names = append(names, e.method)
+		}
+	}
+	return names
+}
+
+type handler struct{ m *Mock }
+
+// Handle implements the jrpc2.Handler interface.
+func (h handler) Handle(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+	var params json.RawMessage
+	if req.HasParams() {
+		if err := req.UnmarshalParams(&params); err != nil {
+			return nil, err
+		}
+	}
+	m := h.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.exps {
+		if e.matches(req.Method(), params) {
+			e.calls++
+			if e.err != nil {
+				return nil, e.err
+			}
+			return e.result, nil
+		}
+	}
+	call := &Call{Method: req.Method(), Params: params}
+	m.unexpected = append(m.unexpected, call)
+	return nil, jrpc2.Errorf(code.MethodNotFound, "unexpected call: %v", call)
+}
+
+// Unexpected returns the calls received by m that did not match any
+// expectation, in the order they were received.
+func (m *Mock) Unexpected() []*Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Call(nil), m.unexpected...)
+}
+
+// Verify reports an error if any expectation of m has not been met, or if m
+// has received any unexpected calls. Otherwise it returns nil.
+func (m *Mock) Verify() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var msgs []string
+	for _, e := range m.exps {
+		if e.met() {
+			continue
+		} else if e.times > 0 {
+			msgs = append(msgs, fmt.Sprintf("expected %d calls to %q, got %d", e.times, e.method, e.calls))
+		} else {
+			msgs = append(msgs, fmt.Sprintf("expected a call to %q, got none", e.method))
+		}
+	}
+	for _, c := range m.unexpected {
+		msgs = append(msgs, fmt.Sprintf("unexpected call: %v", c))
+	}
+	if len(msgs) != 0 {
+		return fmt.Errorf("mock verification failed:\n  %s", strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
+
+// A T is the subset of testing.TB used by Check.
+type T interface {
+	Helper()
+	Error(...interface{})
+}
+
+// Check calls Verify, and reports its error (if any) to t.
+func (m *Mock) Check(t T) {
+	t.Helper()
+	if err := m.Verify(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,110 @@
+package jrpc2test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/code"
+	"github.com/herenow/jrpc2/server"
+)
+
+func TestMock(t *testing.T) {
+	m := NewMock()
+	m.Expect("Add").WithParams(Params([]int{1, 2})).Return(3)
+	m.Expect("Add").Return(0).Times(2)
+	m.Expect("Div").ReturnError(jrpc2.Errorf(code.InvalidParams, "divide by zero"))
+	m.Expect("Find").WithParams(ParamsFunc(func(req struct{ Name string }) bool {
+		return strings.HasPrefix(req.Name, "a")
+	})).Return("found")
+
+	cli, wait := server.Local(m, nil)
+	defer wait()
+	defer cli.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		method string
+		params interface{}
+		want   string
+		code   code.Code
+	}{
+		{"Add", []int{1, 2}, "3", code.NoError},
+		{"Add", []int{1, 2}, "3", code.NoError}, // an expectation may be reused
+		{"Add", []int{5}, "0", code.NoError},
+		{"Add", map[string]int{"x": 1}, "0", code.NoError},
+		{"Add", []int{6}, "", code.MethodNotFound}, // exhausted
+		{"Div", []int{1, 0}, "", code.InvalidParams},
+		{"Find", map[string]string{"Name": "alice"}, `"found"`, code.NoError},
+		{"Find", map[string]string{"Name": "bob"}, "", code.MethodNotFound},
+	}
+	for _, test := range tests {
+		rsp, err := cli.Call(ctx, test.method, test.params)
+		if test.code != code.NoError {
+			if e, ok := err.(*jrpc2.Error); !ok || e.Code() != test.code {
+				t.Errorf("Call %s %v: got error %v, want code %v", test.method, test.params, err, test.code)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("Call %s %v: unexpected error: %v", test.method, test.params, err)
+			continue
+		}
+		var got json.RawMessage
+		if err := rsp.UnmarshalResult(&got); err != nil {
+			t.Errorf("Decoding result: %v", err)
+		} else if string(got) != test.want {
+			t.Errorf("Call %s %v: got %s, want %s", test.method, test.params, string(got), test.want)
+		}
+	}
+
+	// Two calls were unexpected.
+	if got := len(m.Unexpected()); got != 2 {
+		t.Errorf("Unexpected calls: got %d, want 2", got)
+	}
+	err := m.Verify()
+	if err == nil {
+		t.Fatal("Verify: got nil error")
+	}
+	for _, want := range []string{`unexpected call: Add [6]`, `unexpected call: Find {"Name":"bob"}`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Verify: error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	m := NewMock()
+	m.Expect("A").Times(2)
+	m.Expect("B")
+	cli, wait := server.Local(m, nil)
+	defer wait()
+	defer cli.Close()
+
+	if _, err := cli.Call(context.Background(), "A", nil); err != nil {
+		t.Fatalf("Call A: unexpected error: %v", err)
+	}
+	var ft fakeT
+	m.Check(&ft)
+	want := []string{`expected 2 calls to "A", got 1`, `expected a call to "B", got none`}
+	for _, w := range want {
+		if !strings.Contains(ft.msg, w) {
+			t.Errorf("Check: message %q does not mention %q", ft.msg, w)
+		}
+	}
+
+	if _, err := cli.Call(context.Background(), "A", nil); err != nil {
+		t.Fatalf("Call A: unexpected error: %v", err)
+	}
+	if _, err := cli.Call(context.Background(), "B", nil); err != nil {
+		t.Fatalf("Call B: unexpected error: %v", err)
+	}
+	m.Check(t)
+}
+
+type fakeT struct{ msg string }
+
+func (*fakeT) Helper()                     {}
+func (f *fakeT) Error(args ...interface{}) { f.msg += fmt.Sprint(args...) }
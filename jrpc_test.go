@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -314,6 +316,91 @@ func TestClientCancellation(t *testing.T) {
 	}
 }
 
+func TestClientIDs(t *testing.T) {
+	var nextID int
+	started := make(chan struct{})
+	stopped := make(chan bool, 1)
+	_, c, cleanup := newServer(t, MapAssigner{
+		"OK": NewHandler(func(ctx context.Context) (string, error) { return "ok", nil }),
+		"Hang": NewHandler(func(ctx context.Context) (bool, error) {
+			close(started)
+			select {
+			case <-ctx.Done():
+				stopped <- true
+				return true, ctx.Err()
+			case <-time.After(10 * time.Second):
+				stopped <- false
+				return false, nil
+			}
+		}),
+	}, &testOptions{client: &ClientOptions{
+		NewID: func() string { nextID++; return fmt.Sprintf("req-%d", nextID) },
+	}})
+	defer cleanup()
+	ctx := context.Background()
+
+	// Requests are issued with string IDs from the generator.
+	for i := 1; i <= 2; i++ {
+		rsp, err := c.Call(ctx, "OK", nil)
+		if err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+		if got, want := rsp.ID(), fmt.Sprintf(`"req-%d"`, i); got != want {
+			t.Errorf("Response ID: got %s, want %s", got, want)
+		}
+	}
+
+	// Cancellation reaches the server by the string ID.
+	hctx, cancel := context.WithCancel(ctx)
+	rsp, err := c.issue(hctx, "Hang", nil)
+	if err != nil {
+		t.Fatalf("issue failed: %v", err)
+	}
+	<-started
+	cancel()
+	rsp.wait()
+	if err := rsp.Error(); err == nil || err.code != code.Cancelled {
+		t.Errorf("Response for %s: got error %v, want %v", rsp.ID(), err, code.Cancelled)
+	}
+	if ok := <-stopped; !ok {
+		t.Error("Server context was not cancelled")
+	}
+}
+
+func TestClientIDEncoding(t *testing.T) {
+	// A server may echo a string ID using a different encoding than the
+	// client sent; the client must still match it to the pending request.
+	cpipe, spipe := channel.Pipe(channel.Line)
+	c := NewClient(cpipe, &ClientOptions{
+		NewID: func() string { return "<a&b>" },
+	})
+	defer func() { spipe.Close(); c.Close() }()
+	go func() {
+		req, err := spipe.Recv()
+		if err != nil {
+			t.Errorf("Recv failed: %v", err)
+			return
+		}
+		t.Logf("Received request: %s", string(req))
+		spipe.Send([]byte(`{"jsonrpc":"2.0","id":"<a&\u0062>","result":17}`))
+	}()
+	rsp, err := c.Call(context.Background(), "X", nil)
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	var got int
+	if err := rsp.UnmarshalResult(&got); err != nil {
+		t.Errorf("UnmarshalResult: unexpected error: %v", err)
+	} else if got != 17 {
+		t.Errorf("Call result: got %d, want 17", got)
+	}
+
+	// The response reports the ID as the client sent it, without escapes.
+	if got, want := rsp.ID(), `"<a&b>"`; got != want {
+		t.Errorf("Response ID: got %s, want %s", got, want)
+	}
+}
+
 func TestErrors(t *testing.T) {
 	// Test that an error with data attached to it is correctly propagated back
 	// from the server to the client, in a value of concrete type *Error.
@@ -480,6 +567,77 @@ func TestOtherClient(t *testing.T) {
 	}
 }
 
+func TestSplitBatches(t *testing.T) {
+	release := make(chan struct{})
+	assigner := MapAssigner{
+		"Slow": NewHandler(func(ctx context.Context) (string, error) {
+			select {
+			case <-release:
+				return "slow", nil
+			case <-time.After(5 * time.Second):
+				return "", errors.New("slow call timed out")
+			}
+		}),
+		"Fast": NewHandler(func(ctx context.Context) (string, error) {
+			return "fast", nil
+		}),
+	}
+	opts := &ServerOptions{SplitBatches: true, Concurrency: 4}
+
+	// Check the wire format: Responses arrive separately, and the slow call
+	// does not delay the others.
+	srv, cli := channel.Pipe(channel.Line)
+	s := NewServer(assigner, opts).Start(srv)
+	defer func() { cli.Close(); s.Wait() }()
+	if err := cli.Send([]byte(`[{"jsonrpc":"2.0", "id": 1, "method": "Slow"},` +
+		`{"jsonrpc":"2.0", "id": 2, "method": "Fast"},` +
+		`{"jsonrpc":"2.0", "id": 3, "method": "NoneSuch"},` +
+		`{"jsonrpc":"2.0", "id": 4, "method": "Fast", "params": "bad"}]`)); err != nil {
+		t.Fatalf("Send batch failed: %v", err)
+	}
+	got := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		got[string(raw)] = true
+	}
+	for _, want := range []string{
+		`{"jsonrpc":"2.0","id":2,"result":"fast"}`,
+		`{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"no such method \"NoneSuch\""}}`,
+		`{"jsonrpc":"2.0","id":4,"error":{"code":-32600,"message":"parameters must be list or object"}}`,
+	} {
+		if !got[want] {
+			t.Errorf("Missing response %#q; got %v", want, got)
+		}
+	}
+	close(release)
+	if raw, err := cli.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	} else if want := `{"jsonrpc":"2.0","id":1,"result":"slow"}`; string(raw) != want {
+		t.Errorf("Slow response: got %#q, want %#q", string(raw), want)
+	}
+
+	// Check that the client assembles the split responses for a batch.
+	_, c, cleanup := newServer(t, assigner, &testOptions{server: opts})
+	defer cleanup()
+	rsps, err := c.Batch(context.Background(), []Spec{
+		{Method: "Slow"}, {Method: "Fast"}, {Method: "Fast"},
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	for i, want := range []string{"slow", "fast", "fast"} {
+		var got string
+		if err := rsps[i].UnmarshalResult(&got); err != nil {
+			t.Errorf("Response %d: unexpected error: %v", i, err)
+		} else if got != want {
+			t.Errorf("Response %d: got %q, want %q", i, got, want)
+		}
+	}
+}
+
 func TestServerNotify(t *testing.T) {
 	// Set up a server and client with server-side notification support.  Here
 	// we're just capturing the name of the notification method, as a sign we
@@ -555,6 +713,620 @@ func TestContextPlumbing(t *testing.T) {
 	}
 }
 
+func TestAuthentication(t *testing.T) {
+	type token struct {
+		User string `json:"user"`
+	}
+	_, c, cleanup := newServer(t, MapAssigner{
+		"Whoami": NewHandler(func(ctx context.Context) (string, error) {
+			p, _ := Principal(ctx).(string)
+			return p, nil
+		}),
+		"Secret": NewHandler(func(ctx context.Context) (string, error) {
+			return "the owl flies at midnight", nil
+		}),
+	}, &testOptions{
+		server: &ServerOptions{
+			DecodeContext: jctx.Decode,
+			Authenticate: func(ctx context.Context, req *Request) (interface{}, error) {
+				var tok token
+				if req.Method() == "rpc.authenticate" {
+					if err := req.UnmarshalParams(&tok); err != nil {
+						return nil, err
+					}
+				} else if err := jctx.UnmarshalMetadata(ctx, &tok); err != nil {
+					return nil, err
+				}
+				if tok.User == "" {
+					return nil, errors.New("no user name")
+				}
+				return tok.User, nil
+			},
+			Authorize: func(ctx context.Context, req *Request) error {
+				if req.Method() == "Secret" && Principal(ctx) != "root" {
+					return errors.New("only root may know the secret")
+				}
+				return nil
+			},
+		},
+		client: &ClientOptions{EncodeContext: jctx.Encode},
+	})
+	defer cleanup()
+
+	ctx := context.Background()
+	wantCode := func(err error, want code.Code) {
+		t.Helper()
+		if e, ok := err.(*Error); !ok {
+			t.Errorf("Got error %v, want code %v", err, want)
+		} else if e.Code() != want {
+			t.Errorf("Got code %v, want %v", e.Code(), want)
+		}
+	}
+
+	// Without credentials, requests are rejected.
+	var who string
+	err := c.CallResult(ctx, "Whoami", nil, &who)
+	wantCode(err, code.Unauthenticated)
+
+	// Credentials in the request metadata apply to that request only.
+	mctx, err := jctx.WithMetadata(ctx, token{User: "alice"})
+	if err != nil {
+		t.Fatalf("WithMetadata: unexpected error: %v", err)
+	}
+	if err := c.CallResult(mctx, "Whoami", nil, &who); err != nil {
+		t.Errorf("Whoami with metadata: unexpected error: %v", err)
+	} else if who != "alice" {
+		t.Errorf("Whoami with metadata: got %q, want alice", who)
+	}
+	_, err = c.Call(mctx, "Secret", nil)
+	wantCode(err, code.PermissionDenied)
+
+	// A successful handshake applies to the rest of the connection.
+	_, err = c.Call(ctx, "rpc.authenticate", token{})
+	wantCode(err, code.Unauthenticated)
+	if _, err := c.Call(ctx, "rpc.authenticate", token{User: "root"}); err != nil {
+		t.Fatalf("rpc.authenticate: unexpected error: %v", err)
+	}
+	if err := c.CallResult(ctx, "Whoami", nil, &who); err != nil {
+		t.Errorf("Whoami after handshake: unexpected error: %v", err)
+	} else if who != "root" {
+		t.Errorf("Whoami after handshake: got %q, want root", who)
+	}
+	if _, err := c.Call(ctx, "Secret", nil); err != nil {
+		t.Errorf("Secret after handshake: unexpected error: %v", err)
+	}
+}
+
+type testSession struct {
+	sync.Mutex
+	count  int
+	closed int
+}
+
+func (s *testSession) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed++
+	return nil
+}
+
+func TestServerSession(t *testing.T) {
+	var sessions []*testSession
+	srv, c, cleanup := newServer(t, MapAssigner{
+		"Count": NewHandler(func(ctx context.Context) (int, error) {
+			s := ServerSession(ctx).(*testSession)
+			s.Lock()
+			defer s.Unlock()
+			s.count++
+			return s.count, nil
+		}),
+	}, &testOptions{
+		server: &ServerOptions{
+			NewSession: func(context.Context) interface{} {
+				s := new(testSession)
+				sessions = append(sessions, s)
+				return s
+			},
+		},
+	})
+
+	ctx := context.Background()
+	for want := 1; want <= 3; want++ {
+		var got int
+		if err := c.CallResult(ctx, "Count", nil, &got); err != nil {
+			t.Fatalf("Call Count: unexpected error: %v", err)
+		} else if got != want {
+			t.Errorf("Call Count: got %d, want %d", got, want)
+		}
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("Got %d sessions, want 1", len(sessions))
+	}
+	if n := sessions[0].closed; n != 0 {
+		t.Errorf("Session closed %d times before Wait, want 0", n)
+	}
+	select {
+	case <-srv.Done():
+		t.Error("Done: closed while the server is running")
+	default:
+	}
+
+	// The session should be closed exactly once, even if Wait is called again.
+	cleanup()
+	srv.Wait()
+	if n := sessions[0].closed; n != 1 {
+		t.Errorf("Session closed %d times after Wait, want 1", n)
+	}
+	select {
+	case <-srv.Done():
+	default:
+		t.Error("Done: not closed after the server stopped")
+	}
+}
+
+// pushSession is a session whose Close pushes a notification to its server.
+type pushSession struct {
+	srv *Server
+	err chan error
+}
+
+func (s *pushSession) Close() error {
+	s.err <- s.srv.Push(context.Background(), "goodbye", nil)
+	return nil
+}
+
+func TestServerSessionClosePush(t *testing.T) {
+	session := &pushSession{err: make(chan error, 1)}
+	srv, _, cleanup := newServer(t, MapAssigner{}, &testOptions{
+		server: &ServerOptions{
+			AllowPush:  true,
+			NewSession: func(context.Context) interface{} { return session },
+		},
+	})
+	session.srv = srv
+
+	// Closing the session calls back into the server, which must not
+	// deadlock. The server has stopped, so the push reports an error.
+	done := make(chan struct{})
+	go func() { defer close(done); cleanup() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after the session pushed a notification")
+	}
+	if err := <-session.err; err != errServerStopped {
+		t.Errorf("Push from Close: got %v, want %v", err, errServerStopped)
+	}
+}
+
+// orderLog is a test service that records the order in which its Append
+// method is executed.
+type orderLog struct {
+	sync.Mutex
+	vals []int
+
+	gate    chan struct{} // Append waits until this is closed
+	meet    chan struct{} // for Meet calls to rendezvous
+	entered chan struct{} // receives a value when Meet is called
+	hold    chan struct{} // Meet gives up when this is closed
+}
+
+func newOrderLog() *orderLog {
+	return &orderLog{
+		gate:    make(chan struct{}),
+		meet:    make(chan struct{}),
+		entered: make(chan struct{}, 2),
+		hold:    make(chan struct{}),
+	}
+}
+
+// Append records vs, once the gate is open. Requests that are not ordered are
+// all released at once, so they are likely to complete out of order.
+func (o *orderLog) Append(ctx context.Context, vs ...int) error {
+	<-o.gate
+	for _, v := range vs {
+		o.Lock()
+		o.vals = append(o.vals, v)
+		o.Unlock()
+	}
+	return nil
+}
+
+func (o *orderLog) Get(ctx context.Context) ([]int, error) {
+	o.Lock()
+	defer o.Unlock()
+	return o.vals, nil
+}
+
+// Meet blocks until another call to Meet arrives, or until hold is closed, and
+// reports whether it met another call.
+func (o *orderLog) Meet(ctx context.Context) (bool, error) {
+	o.entered <- struct{}{}
+	select {
+	case o.meet <- struct{}{}:
+		return true, nil
+	case <-o.meet:
+		return true, nil
+	case <-o.hold:
+		return false, nil
+	}
+}
+
+func TestOrdering(t *testing.T) {
+	tests := []struct {
+		desc string
+		opts *ServerOptions
+		meet bool // whether calls can run concurrently
+	}{
+		{"Sequential", &ServerOptions{Ordering: Sequential}, false},
+		{"OrderedNotifications", &ServerOptions{Ordering: OrderedNotifications}, true},
+		{"SerializeKey", &ServerOptions{SerializeKey: func(req *Request) string {
+			if req.Method() == "Log.Append" {
+				return "log"
+			}
+			return ""
+		}}, true},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			log := newOrderLog()
+			test.opts.Concurrency = 16
+			_, c, cleanup := newServer(t, ServiceMapper{
+				"Log": NewService(log),
+			}, &testOptions{server: test.opts})
+			defer cleanup()
+
+			var want []int
+			for i := 0; i < 20; i++ {
+				if err := c.Notify(ctx, "Log.Append", []int{i}); err != nil {
+					t.Fatalf("Notify Append(%d): unexpected error: %v", i, err)
+				}
+				want = append(want, i)
+			}
+			close(log.gate)
+			if _, err := c.Call(ctx, "Log.Append", []int{20}); err != nil {
+				t.Fatalf("Call Append(20): unexpected error: %v", err)
+			}
+			want = append(want, 20)
+			var got []int
+			if err := c.CallResult(ctx, "Log.Get", nil, &got); err != nil {
+				t.Fatalf("Call Get: unexpected error: %v", err)
+			} else if !reflect.DeepEqual(got, want) {
+				t.Errorf("Call Get: got %v, want %v", got, want)
+			}
+
+			// Check whether calls are allowed to overlap. If not, release the
+			// first call once it starts; the second cannot have started yet.
+			if !test.meet {
+				go func() { <-log.entered; close(log.hold) }()
+			}
+			rsps, err := c.Batch(ctx, []Spec{{Method: "Log.Meet"}, {Method: "Log.Meet"}})
+			if err != nil {
+				t.Fatalf("Batch Meet: unexpected error: %v", err)
+			}
+			for _, rsp := range rsps {
+				var met bool
+				if err := rsp.UnmarshalResult(&met); err != nil {
+					t.Errorf("Meet: unexpected error: %v", err)
+				} else if met != test.meet {
+					t.Errorf("Meet: got %v, want %v", met, test.meet)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderingCancel(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	_, c, cleanup := newServer(t, MapAssigner{
+		"Stuck": NewHandler(func(ctx context.Context) (bool, error) {
+			close(entered)
+			<-release // N.B. ignores ctx
+			return true, nil
+		}),
+		"Quick": NewHandler(func(ctx context.Context) (bool, error) { return true, nil }),
+	}, &testOptions{server: &ServerOptions{Ordering: Sequential, Concurrency: 4}})
+	defer cleanup()
+
+	// Issue a call that blocks, followed by a call ordered after it.
+	ctx, cancel := context.WithCancel(context.Background())
+	batch := make(chan struct{})
+	go func() {
+		defer close(batch)
+		c.Batch(ctx, []Spec{{Method: "Stuck"}, {Method: "Quick"}})
+	}()
+	<-entered
+
+	// Cancelling the waiting call releases the calls ordered after it, even
+	// though the call it waits for is still blocked.
+	cancel()
+	probe := make(chan error, 1)
+	go func() {
+		_, err := c.Call(context.Background(), "Quick", nil)
+		probe <- err
+	}()
+	select {
+	case err := <-probe:
+		if err != nil {
+			t.Errorf("Call Quick: unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Call Quick is still waiting behind a cancelled call")
+	}
+	close(release)
+	<-batch
+}
+
+func TestRateLimit(t *testing.T) {
+	_, c, cleanup := newServer(t, MapAssigner{
+		"A": NewHandler(func(ctx context.Context) (bool, error) { return true, nil }),
+		"B": NewHandler(func(ctx context.Context) (bool, error) { return true, nil }),
+	}, &testOptions{
+		server: &ServerOptions{
+			RateLimit:       &Rate{Limit: 10, Burst: 3},
+			MethodRateLimit: map[string]Rate{"B": {Limit: 0.001, Burst: 1}},
+		},
+	})
+	defer cleanup()
+
+	ctx := context.Background()
+	wantLimited := func(err error) {
+		t.Helper()
+		e, ok := err.(*Error)
+		if !ok || e.Code() != code.RateLimited {
+			t.Fatalf("Got error %v, want code %v", err, code.RateLimited)
+		}
+		var data struct {
+			RetryAfter float64 `json:"retryAfter"`
+		}
+		if err := e.UnmarshalData(&data); err != nil {
+			t.Errorf("UnmarshalData: unexpected error: %v", err)
+		} else if data.RetryAfter <= 0 {
+			t.Errorf("Retry after: got %v, want > 0", data.RetryAfter)
+		}
+	}
+
+	// The method limit for B allows only one call.
+	if _, err := c.Call(ctx, "B", nil); err != nil {
+		t.Fatalf("Call B: unexpected error: %v", err)
+	}
+	_, err := c.Call(ctx, "B", nil)
+	wantLimited(err)
+
+	// The connection limit allows a burst of three, including the calls to B
+	// that were accepted.
+	for i := 0; i < 2; i++ {
+		if _, err := c.Call(ctx, "A", nil); err != nil {
+			t.Fatalf("Call A: unexpected error: %v", err)
+		}
+	}
+	_, err = c.Call(ctx, "A", nil)
+	wantLimited(err)
+
+	// Built-in methods are not limited.
+	if _, err := c.Call(ctx, "rpc.serverInfo", nil); err != nil {
+		t.Errorf("Call rpc.serverInfo: unexpected error: %v", err)
+	}
+
+	// After waiting, the bucket is refilled.
+	time.Sleep(150 * time.Millisecond)
+	if _, err := c.Call(ctx, "A", nil); err != nil {
+		t.Errorf("Call A after waiting: unexpected error: %v", err)
+	}
+}
+
+func TestRateLimitAuth(t *testing.T) {
+	_, c, cleanup := newServer(t, MapAssigner{
+		"A":      NewHandler(func(ctx context.Context) (bool, error) { return true, nil }),
+		"Secret": NewHandler(func(ctx context.Context) (bool, error) { return true, nil }),
+	}, &testOptions{
+		server: &ServerOptions{
+			RateLimit: &Rate{Limit: 0.001, Burst: 2},
+			Authorize: func(ctx context.Context, req *Request) error {
+				if req.Method() == "Secret" {
+					return errors.New("not allowed")
+				}
+				return nil
+			},
+		},
+	})
+	defer cleanup()
+
+	// Denied requests do not consume tokens.
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := c.Call(ctx, "Secret", nil)
+		if e, ok := err.(*Error); !ok || e.Code() != code.PermissionDenied {
+			t.Fatalf("Call Secret: got %v, want code %v", err, code.PermissionDenied)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Call(ctx, "A", nil); err != nil {
+			t.Fatalf("Call A: unexpected error: %v", err)
+		}
+	}
+	_, err := c.Call(ctx, "A", nil)
+	if e, ok := err.(*Error); !ok || e.Code() != code.RateLimited {
+		t.Errorf("Call A: got %v, want code %v", err, code.RateLimited)
+	}
+}
+
+func TestRateLimitHandshake(t *testing.T) {
+	_, c, cleanup := newServer(t, MapAssigner{}, &testOptions{
+		server: &ServerOptions{
+			RateLimit: &Rate{Limit: 0.001, Burst: 2},
+			Authenticate: func(ctx context.Context, req *Request) (interface{}, error) {
+				if req.Method() == "rpc.authenticate" {
+					return nil, errors.New("wrong password")
+				}
+				return "guest", nil
+			},
+		},
+	})
+	defer cleanup()
+
+	// Attempts to authenticate count against the limit, even if they fail.
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, err := c.Call(ctx, "rpc.authenticate", nil)
+		if e, ok := err.(*Error); !ok || e.Code() != code.Unauthenticated {
+			t.Fatalf("rpc.authenticate: got %v, want code %v", err, code.Unauthenticated)
+		}
+	}
+	_, err := c.Call(ctx, "rpc.authenticate", nil)
+	if e, ok := err.(*Error); !ok || e.Code() != code.RateLimited {
+		t.Errorf("rpc.authenticate: got %v, want code %v", err, code.RateLimited)
+	}
+
+	// Other built-in methods are not limited.
+	if _, err := c.Call(ctx, "rpc.serverInfo", nil); err != nil {
+		t.Errorf("rpc.serverInfo: unexpected error: %v", err)
+	}
+}
+
+func TestBatchErrors(t *testing.T) {
+	srv, cli := channel.Pipe(channel.Line)
+	s := NewServer(MapAssigner{
+		"OK": NewHandler(func(ctx context.Context) (string, error) { return "ok", nil }),
+		"Bad": NewHandler(func(ctx context.Context) (json.RawMessage, error) {
+			return json.RawMessage(`{"malformed`), nil
+		}),
+		"Empty": NewHandler(func(ctx context.Context) (json.RawMessage, error) {
+			return nil, nil
+		}),
+	}, nil).Start(srv)
+	defer func() { cli.Close(); s.Wait() }()
+
+	tests := []struct {
+		input, want string
+	}{
+		// Each invalid element gets its own error, with its ID if it has one.
+		{`[{"jsonrpc":"2.0","id":1,"method":"OK"},` +
+			`{"jsonrpc":"2.0","id":2,"method":"OK","params":"bad"},` +
+			`{"jsonrpc":"2.0","id":3,"method":4},` +
+			`{"jsonrpc":"2.0","method":"OK","params":"bad"},` +
+			`17]`,
+			`[{"jsonrpc":"2.0","id":1,"result":"ok"},` +
+				`{"jsonrpc":"2.0","id":2,"error":{"code":-32600,"message":"parameters must be list or object"}},` +
+				`{"jsonrpc":"2.0","id":3,"error":{"code":-32600,"message":"invalid request: method has wrong type number"}},` +
+				`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"parameters must be list or object"}},` +
+				`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request object"}}]`},
+
+		// A batch with one response is still answered with an array.
+		{`[{"jsonrpc":"2.0","id":5,"method":"OK"},{"jsonrpc":"2.0","method":"OK"}]`,
+			`[{"jsonrpc":"2.0","id":5,"result":"ok"}]`},
+
+		// A message that is not valid JSON does not stop the server.
+		{`{"jsonrpc":"2.0", "id": 6, "method`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid JSON request message"}}`},
+		{`{"jsonrpc":"2.0","id":7,"method":"OK"}`, `{"jsonrpc":"2.0","id":7,"result":"ok"}`},
+		{`[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty request batch"}}`},
+
+		// A malformed result is reported as an error without losing the other
+		// responses in the batch.
+		{`[{"jsonrpc":"2.0","id":8,"method":"Bad"},{"jsonrpc":"2.0","id":9,"method":"OK"}]`,
+			`[{"jsonrpc":"2.0","id":8,"error":{"code":-32603,"message":"internal error: invalid result"}},` +
+				`{"jsonrpc":"2.0","id":9,"result":"ok"}]`},
+
+		// An empty result is reported as null, so the response has a result.
+		{`{"jsonrpc":"2.0","id":10,"method":"Empty"}`, `{"jsonrpc":"2.0","id":10,"result":null}`},
+	}
+	for _, test := range tests {
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		} else if got := string(raw); got != test.want {
+			t.Errorf("Input %#q:\n got %#q\nwant %#q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestPeer(t *testing.T) {
+	lhs, rhs := channel.Pipe(channel.Line)
+	var a, b *Peer
+	notes := make(chan string, 1)
+	a = NewPeer(lhs, MapAssigner{
+		// Ping calls back to the remote peer while handling a request.
+		"Ping": NewHandler(func(ctx context.Context, msg ...string) (string, error) {
+			var echo string
+			if err := a.CallResult(ctx, "Echo", msg, &echo); err != nil {
+				return "", err
+			}
+			return "pong " + echo, nil
+		}),
+		"Note": NewHandler(func(ctx context.Context, msg ...string) (bool, error) {
+			notes <- strings.Join(msg, " ")
+			return true, nil
+		}),
+	}, nil)
+	b = NewPeer(rhs, nil, nil)
+	b.Handle("Echo", NewHandler(func(ctx context.Context, msg ...string) (string, error) {
+		return strings.Join(msg, " "), nil
+	}))
+	defer func() {
+		t.Logf("Close a: err=%v", a.Close())
+		t.Logf("Close b: err=%v", b.Close())
+	}()
+	ctx := context.Background()
+
+	var got string
+	if err := b.CallResult(ctx, "Ping", []string{"hello"}, &got); err != nil {
+		t.Fatalf("Call Ping: unexpected error: %v", err)
+	} else if want := "pong hello"; got != want {
+		t.Errorf("Call Ping: got %q, want %q", got, want)
+	}
+	if err := b.Notify(ctx, "Note", []string{"noted"}); err != nil {
+		t.Fatalf("Notify: unexpected error: %v", err)
+	} else if got := <-notes; got != "noted" {
+		t.Errorf("Notify: got %q, want %q", got, "noted")
+	}
+	rsps, err := a.Batch(ctx, []Spec{
+		{Method: "Echo", Params: []string{"x"}},
+		{Method: "Echo", Params: []string{"y"}},
+	})
+	if err != nil {
+		t.Fatalf("Batch: unexpected error: %v", err)
+	}
+	for i, want := range []string{"x", "y"} {
+		var got string
+		if err := rsps[i].UnmarshalResult(&got); err != nil || got != want {
+			t.Errorf("Batch response %d: got %q, %v; want %q", i, got, err, want)
+		}
+	}
+
+	// Removing a handler makes its method unavailable.
+	b.Handle("Echo", nil)
+	if _, err := a.Call(ctx, "Echo", []string{"z"}); code.FromError(err) != code.MethodNotFound {
+		t.Errorf("Call removed method: got %v, want %v", err, code.MethodNotFound)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		input, reqs, rsps string
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"X"}`, `{"jsonrpc":"2.0","id":1,"method":"X"}`, ""},
+		{`{"jsonrpc":"2.0","method":"X"}`, `{"jsonrpc":"2.0","method":"X"}`, ""},
+		{`{"jsonrpc":"2.0","id":1,"result":2}`, "", `{"jsonrpc":"2.0","id":1,"result":2}`},
+		{`{"bogus`, `{"bogus`, ""},
+		{`[]`, `[]`, ""},
+		{`[{"id":1,"method":"X"},{"id":2,"result":3},{"id":3,"error":{}}]`,
+			`[{"id":1,"method":"X"}]`, `[{"id":2,"result":3},{"id":3,"error":{}}]`},
+	}
+	for _, test := range tests {
+		reqs, rsps := splitMessage([]byte(test.input))
+		if string(reqs) != test.reqs || string(rsps) != test.rsps {
+			t.Errorf("splitMessage(%#q): got %#q, %#q; want %#q, %#q",
+				test.input, string(reqs), string(rsps), test.reqs, test.rsps)
+		}
+	}
+}
+
 func TestSpecialMethods(t *testing.T) {
 	s := NewServer(MapAssigner{
 		"rpc.nonesuch": NewHandler(func(context.Context) (string, error) { return "OK", nil }),
@@ -0,0 +1,82 @@
+package jrpc2
+
+import (
+	"math"
+	"time"
+
+	"github.com/herenow/jrpc2/code"
+)
+
+// A bucket is a token bucket implementing a Rate. It is not safe for
+// concurrent use without external synchronization.
+type bucket struct {
+	rate   float64   // tokens added per second
+	burst  float64   // maximum number of tokens
+	tokens float64   // tokens available as of last
+	last   time.Time // when tokens was last updated
+}
+
+func newBucket(r Rate) *bucket {
+	burst := float64(r.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &bucket{rate: r.Limit, burst: burst, tokens: burst}
+}
+
+// refill adds the tokens accumulated since the last update as of now.
+func (b *bucket) refill(now time.Time) {
+	if !b.last.IsZero() && b.rate > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// wait reports how long from now until a token will be available, or 0 if one
+// is available now. The caller must call refill first.
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	} else if b.rate <= 0 {
+		return time.Duration(math.MaxInt64) // the bucket is never refilled
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// checkRate reports whether a request for the given method is within the rate
+// limits of s, consuming a token from each applicable bucket if so. If not, it
+// returns an error with code.RateLimited. The caller must hold s.mu.
+func (s *Server) checkRate(method string) error {
+	if s.limit == nil && s.limits == nil {
+		return nil
+	} else if s.allowB && (method == "rpc.cancel" || method == "rpc.serverInfo") {
+		return nil // these built-ins are not limited
+	}
+	now := time.Now()
+	var wait time.Duration
+	var use []*bucket
+	for _, b := range []*bucket{s.limit, s.limits[method]} {
+		if b != nil {
+			b.refill(now)
+			if w := b.wait(); w > wait {
+				wait = w
+			}
+			use = append(use, b)
+		}
+	}
+	if wait > 0 {
+		s.metrics.Count("rpc.rateLimited", 1)
+		return DataErrorf(code.RateLimited, rateLimitData{
+			RetryAfter: wait.Seconds(),
+		}, "rate limit exceeded for %q", method)
+	}
+	for _, b := range use {
+		b.tokens--
+	}
+	return nil
+}
+
+// rateLimitData is the error data reported for a rate-limited request.
+type rateLimitData struct {
+	RetryAfter float64 `json:"retryAfter"` // seconds
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"strconv"
 
 	"github.com/herenow/jrpc2/metrics"
 )
@@ -28,10 +29,43 @@ type ServerOptions struct {
 	// Instructs the server to disable the built-in rpc.* handler methods.
 	DisableBuiltin bool
 
+	// Instructs the server to send the response to each request in a batch as
+	// soon as its handler completes, rather than waiting for the whole batch
+	// to finish. Each response is sent as a separate message. This is a
+	// non-standard extension of JSON-RPC; a *jrpc2.Client accepts such
+	// responses, but other clients may not.
+	SplitBatches bool
+
 	// Allows up to the specified number of concurrent goroutines to execute
 	// when processing requests. A value less than 1 uses runtime.NumCPU().
 	Concurrency int
 
+	// Controls the order in which the server executes the requests it receives
+	// from the client. The default is Concurrent. Ordering does not affect the
+	// built-in rpc.* methods.
+	Ordering Ordering
+
+	// If set, this function is called for each request to obtain a
+	// serialization key. Requests that report the same non-empty key are
+	// executed one at a time, in the order they were received, regardless of
+	// the Ordering policy. Requests with an empty key are not constrained.
+	SerializeKey func(*Request) string
+
+	// If set, limits the rate at which the server accepts requests from the
+	// client. Requests that exceed the limit fail with code.RateLimited
+	// without invoking the handler. The error data is an object whose
+	// "retryAfter" field gives the number of seconds the client should wait
+	// before trying again. The built-in rpc.cancel and rpc.serverInfo
+	// methods are not limited, but rpc.authenticate is, so that a client
+	// cannot guess credentials without limit. Requests rejected by
+	// Authenticate or Authorize do not count against the limit.
+	RateLimit *Rate
+
+	// If set, limits the rate at which the server accepts requests for each
+	// method named in the map, in the same way as RateLimit. A request must
+	// satisfy both its method limit and RateLimit (if set) to be accepted.
+	MethodRateLimit map[string]Rate
+
 	// If set, this function is called with the encoded request parameters
 	// received from the client, before they are delivered to the handler.  Its
 	// return value replaces the context and argument values. This allows the
@@ -39,10 +73,42 @@ type ServerOptions struct {
 	// params are used as given.
 	DecodeContext func(context.Context, json.RawMessage) (context.Context, json.RawMessage, error)
 
+	// If set, this function is called to create the base context for each
+	// request, before it is passed to DecodeContext. This allows the caller to
+	// attach values, such as details of the connection, that every handler
+	// can see. If unset, the base context is context.Background().
+	NewContext func() context.Context
+
+	// If set, this function is called when the server starts, to create a
+	// session value that holds state for the connection. The context is
+	// obtained from NewContext. Handlers can recover the session using
+	// jrpc2.ServerSession. When the server exits, if the session implements
+	// io.Closer its Close method is called before Wait returns.
+	NewSession func(ctx context.Context) interface{}
+
 	// If set, use this value to record server metrics. All servers created
 	// from the same options will share the same metrics collector.  If none is
 	// set, an empty collector will be created for each new server.
 	Metrics *metrics.M
+
+	// If set, this function is called to identify the caller before a request
+	// is dispatched to its handler. The context has already been processed by
+	// DecodeContext (if set), so the function may inspect request metadata.
+	// The principal it returns is attached to the handler context, and can be
+	// recovered using jrpc2.Principal. If it reports an error, the request
+	// fails without invoking the handler.
+	//
+	// When this is set and built-in methods are enabled, the server also
+	// exports an "rpc.authenticate" method, whose parameters are passed to
+	// Authenticate. If that succeeds, the principal is retained for the
+	// remainder of the connection, and Authenticate is not called for
+	// subsequent requests.
+	Authenticate func(ctx context.Context, req *Request) (interface{}, error)
+
+	// If set, this function is called for each request after authentication,
+	// with the principal (if any) attached to ctx. If it reports an error, the
+	// request fails with code.PermissionDenied without invoking the handler.
+	Authorize func(ctx context.Context, req *Request) error
 }
 
 func (s *ServerOptions) logger() logger {
@@ -56,6 +122,7 @@ func (s *ServerOptions) logger() logger {
 func (s *ServerOptions) allowV1() bool      { return s != nil && s.AllowV1 }
 func (s *ServerOptions) allowPush() bool    { return s != nil && s.AllowPush }
 func (s *ServerOptions) allowBuiltin() bool { return s == nil || !s.DisableBuiltin }
+func (s *ServerOptions) splitBatches() bool { return s != nil && s.SplitBatches }
 
 func (s *ServerOptions) concurrency() int64 {
 	if s == nil || s.Concurrency < 1 {
@@ -64,6 +131,69 @@ func (s *ServerOptions) concurrency() int64 {
 	return int64(s.Concurrency)
 }
 
+// Ordering is a policy for the order in which a server executes requests.
+type Ordering int
+
+const (
+	// Concurrent requests may execute concurrently, up to the limit set by the
+	// Concurrency option, and may complete in any order.
+	Concurrent Ordering = iota
+
+	// Sequential requests are executed one at a time, in the order they were
+	// received. Within a batch, requests are executed in the order they occur
+	// in the batch.
+	Sequential
+
+	// OrderedNotifications are executed one at a time in the order they were
+	// received, and each call waits for all the notifications received before
+	// it to complete. Calls may execute concurrently with each other, and with
+	// notifications received after them.
+	OrderedNotifications
+)
+
+func (s *ServerOptions) ordering() Ordering {
+	if s == nil {
+		return Concurrent
+	}
+	return s.Ordering
+}
+
+// A Rate specifies a token-bucket rate limit. The bucket holds up to Burst
+// tokens, and is refilled at Limit tokens per second. Each request consumes a
+// single token, and is rejected if none is available. A Burst less than 1 is
+// treated as 1.
+type Rate struct {
+	Limit float64 // tokens per second
+	Burst int     // maximum number of tokens
+}
+
+func (s *ServerOptions) rateLimits() (*bucket, map[string]*bucket) {
+	if s == nil {
+		return nil, nil
+	}
+	var conn *bucket
+	if s.RateLimit != nil {
+		conn = newBucket(*s.RateLimit)
+	}
+	var byMethod map[string]*bucket
+	if len(s.MethodRateLimit) != 0 {
+		byMethod = make(map[string]*bucket)
+		for method, rate := range s.MethodRateLimit {
+			byMethod[method] = newBucket(rate)
+		}
+	}
+	return conn, byMethod
+}
+
+type serializer = func(*Request) string
+
+func (s *ServerOptions) serializeKey() serializer {
+	if s == nil {
+		return nil
+	}
+	return s.SerializeKey
+}
+
 type decoder = func(context.Context, json.RawMessage) (context.Context, json.RawMessage, error)
 
 func (s *ServerOptions) decodeContext() (decoder, bool) {
@@ -75,6 +205,40 @@ func (s *ServerOptions) decodeContext() (decoder, bool) {
 	return s.DecodeContext, true
 }
 
+func (s *ServerOptions) newContext() func() context.Context {
+	if s == nil || s.NewContext == nil {
+		return context.Background
+	}
+	return s.NewContext
+}
+
+type sessioner = func(context.Context) interface{}
+
+func (s *ServerOptions) newSession() sessioner {
+	if s == nil || s.NewSession == nil {
+		return func(context.Context) interface{} { return nil }
+	}
+	return s.NewSession
+}
+
+type authenticator = func(context.Context, *Request) (interface{}, error)
+
+func (s *ServerOptions) authenticate() authenticator {
+	if s == nil {
+		return nil
+	}
+	return s.Authenticate
+}
+
+type authorizer = func(context.Context, *Request) error
+
+func (s *ServerOptions) authorize() authorizer {
+	if s == nil {
+		return nil
+	}
+	return s.Authorize
+}
+
 func (s *ServerOptions) metrics() *metrics.M {
 	if s == nil || s.Metrics == nil {
 		return metrics.New()
@@ -92,6 +256,12 @@ type ClientOptions struct {
 	// required "jsonrpc" version marker.
 	AllowV1 bool
 
+	// If set, this function is called to generate the ID for each request,
+	// which is sent as a JSON string. The IDs must be unique among the
+	// client's pending requests; calls to the function are serialized by the
+	// client. If unset, the client uses sequential integer IDs.
+	NewID func() string
+
 	// If set, this function is called with the context and encoded request
 	// parameters before the request is sent to the server. Its return value
 	// replaces the request parameters. This allows the client to send context
@@ -116,6 +286,23 @@ func (c *ClientOptions) logger() logger {
 
 func (c *ClientOptions) allowV1() bool { return c != nil && c.AllowV1 }
 
+type idgen = func() json.RawMessage
+
+func (c *ClientOptions) newID() idgen {
+	if c == nil || c.NewID == nil {
+		var nextID int64
+		return func() json.RawMessage {
+			nextID++
+			return json.RawMessage(strconv.FormatInt(nextID, 10))
+		}
+	}
+	newID := c.NewID
+	return func() json.RawMessage {
+		bits, _ := json.Marshal(newID()) // cannot fail for a string
+		return bits
+	}
+}
+
 type encoder = func(context.Context, json.RawMessage) (json.RawMessage, error)
 
 func (c *ClientOptions) encodeContext() encoder {
@@ -0,0 +1,289 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"bitbucket.org/creachadair/stringset"
+	"github.com/herenow/jrpc2/channel"
+)
+
+// A Peer is a symmetric JSON-RPC endpoint that both serves requests and issues
+// calls over a single channel. A Client and a Server each require exclusive
+// use of the receive side of their channel, so they cannot share a connection
+// directly. A Peer owns the channel, and separates the incoming messages into
+// requests, which are handled by its server, and responses, which are
+// delivered to the calls pending on its client.
+//
+// A Peer serves the methods of the Assigner given to NewPeer, together with
+// any handlers registered by its Handle method. Server push notifications
+// from the remote peer are delivered as notifications to the local server.
+type Peer struct {
+	ch   channel.Channel // the underlying channel
+	smu  sync.Mutex      // serializes sends on ch
+	reqs *peerChannel    // requests, for the server
+	rsps *peerChannel    // responses, for the client
+
+	srv *Server
+	cli *Client
+
+	mu       sync.RWMutex // protects the fields below
+	base     Assigner     // the assigner given to NewPeer, or nil
+	handlers MapAssigner  // handlers added by Handle
+}
+
+// PeerOptions control the behaviour of a peer created by NewPeer.
+// A nil *PeerOptions provides sensible defaults.
+type PeerOptions struct {
+	// Options for the server side of the peer.
+	Server *ServerOptions
+
+	// Options for the client side of the peer. The OnNotify callback is not
+	// used, since notifications from the remote peer are delivered to the
+	// server side.
+	Client *ClientOptions
+}
+
+func (o *PeerOptions) serverOptions() *ServerOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Server
+}
+
+func (o *PeerOptions) clientOptions() *ClientOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Client
+}
+
+// NewPeer returns a new peer that communicates with a remote peer via ch, and
+// serves the methods of assigner. The assigner may be nil, if handlers will
+// be added with Handle. The peer begins serving requests immediately.
+func NewPeer(ch channel.Channel, assigner Assigner, opts *PeerOptions) *Peer {
+	p := &Peer{
+		ch:       ch,
+		base:     assigner,
+		handlers: make(MapAssigner),
+	}
+	p.reqs = newPeerChannel(p.send)
+	p.rsps = newPeerChannel(p.send)
+	p.srv = NewServer(peerAssigner{p}, opts.serverOptions()).Start(p.reqs)
+	p.cli = NewClient(p.rsps, opts.clientOptions())
+	go p.demux()
+	return p
+}
+
+// Handle registers h as the handler for the named method, replacing any
+// previous handler for that name. Handlers registered by Handle take
+// precedence over the assigner given to NewPeer. If h == nil, any handler
+// registered for method is removed.
+func (p *Peer) Handle(method string, h Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h == nil {
+		delete(p.handlers, method)
+	} else {
+		p.handlers[method] = h
+	}
+}
+
+// Call invokes the named method on the remote peer, as Client.Call.
+func (p *Peer) Call(ctx context.Context, method string, params interface{}) (*Response, error) {
+	return p.cli.Call(ctx, method, params)
+}
+
+// CallResult invokes the named method on the remote peer and decodes its
+// result into result, as Client.CallResult.
+func (p *Peer) CallResult(ctx context.Context, method string, params, result interface{}) error {
+	return p.cli.CallResult(ctx, method, params, result)
+}
+
+// Batch issues a batch of requests to the remote peer, as Client.Batch.
+func (p *Peer) Batch(ctx context.Context, specs []Spec) ([]*Response, error) {
+	return p.cli.Batch(ctx, specs)
+}
+
+// Notify sends a notification to the remote peer, as Client.Notify.
+func (p *Peer) Notify(ctx context.Context, method string, params interface{}) error {
+	return p.cli.Notify(ctx, method, params)
+}
+
+// Client returns the client used by p to issue calls to the remote peer.
+func (p *Peer) Client() *Client { return p.cli }
+
+// Server returns the server used by p to handle requests from the remote peer.
+func (p *Peer) Server() *Server { return p.srv }
+
+// Close shuts down the peer, abandoning any pending calls, and closes the
+// underlying channel. It returns the result of Wait.
+func (p *Peer) Close() error {
+	p.cli.Close()
+	p.srv.Stop()
+	p.ch.Close()
+	return p.Wait()
+}
+
+// Wait blocks until the server side of the peer has stopped and its pending
+// handlers have returned, and returns the resulting error as Server.Wait.
+func (p *Peer) Wait() error { return p.srv.Wait() }
+
+// send transmits msg on the underlying channel. Both the client and the server
+// share the channel, so sends must be serialized.
+func (p *Peer) send(msg []byte) error {
+	p.smu.Lock()
+	defer p.smu.Unlock()
+	return p.ch.Send(msg)
+}
+
+// demux receives messages from the underlying channel, and forwards requests
+// to the server and responses to the client until the channel fails.
+func (p *Peer) demux() {
+	defer p.reqs.shut()
+	defer p.rsps.shut()
+	for {
+		msg, err := p.ch.Recv()
+		if err != nil && !(err == io.EOF && len(msg) != 0) {
+			return
+		}
+		reqs, rsps := splitMessage(msg)
+		if reqs != nil {
+			p.reqs.deliver(reqs)
+		}
+		if rsps != nil {
+			p.rsps.deliver(rsps)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// splitMessage separates the requests in msg from the responses. A message
+// that is a batch is split into separate batches of requests and responses,
+// either of which may be nil if there are none. An element is a response if
+// it has no "method" field. Messages that are not valid JSON are treated as
+// requests, so that the server reports an error for them.
+func splitMessage(msg []byte) (reqs, rsps []byte) {
+	isReq := func(elt json.RawMessage) bool {
+		var probe struct {
+			M *json.RawMessage `json:"method"`
+		}
+		return json.Unmarshal(elt, &probe) != nil || probe.M != nil
+	}
+	if !isArray(msg) {
+		if isReq(msg) {
+			return msg, nil
+		}
+		return nil, msg
+	}
+	var elts []json.RawMessage
+	if err := json.Unmarshal(msg, &elts); err != nil || len(elts) == 0 {
+		return msg, nil
+	}
+	var qs, ps []json.RawMessage
+	for _, elt := range elts {
+		if isReq(elt) {
+			qs = append(qs, elt)
+		} else {
+			ps = append(ps, elt)
+		}
+	}
+	if len(ps) == 0 {
+		return msg, nil
+	} else if len(qs) == 0 {
+		return nil, msg
+	}
+	reqs, _ = json.Marshal(qs)
+	rsps, _ = json.Marshal(ps)
+	return reqs, rsps
+}
+
+// peerAssigner implements Assigner for the server side of a peer.
+type peerAssigner struct{ p *Peer }
+
+// Assign implements part of the Assigner interface.
+func (a peerAssigner) Assign(method string) Handler {
+	a.p.mu.RLock()
+	defer a.p.mu.RUnlock()
+	if h := a.p.handlers[method]; h != nil {
+		return h
+	} else if a.p.base != nil {
+		return a.p.base.Assign(method)
+	}
+	return nil
+}
+
+// Names implements part of the Assigner interface.
+func (a peerAssigner) Names() []string {
+	a.p.mu.RLock()
+	defer a.p.mu.RUnlock()
+	names := stringset.FromKeys(a.p.handlers)
+	if a.p.base != nil {
+		names.Add(a.p.base.Names()...)
+	}
+	return names.Elements()
+}
+
+// A peerChannel is a channel.Channel that receives the messages delivered to
+// it by a peer, and sends messages on the peer's underlying channel.
+type peerChannel struct {
+	send func([]byte) error
+	in   chan []byte   // messages delivered by the peer
+	gone chan struct{} // closed when the input ends
+	done chan struct{} // closed by Close
+
+	once sync.Once
+}
+
+func newPeerChannel(send func([]byte) error) *peerChannel {
+	return &peerChannel{
+		send: send,
+		in:   make(chan []byte),
+		gone: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// deliver delivers msg to the receiver of c, unless c has been closed.
+func (c *peerChannel) deliver(msg []byte) {
+	select {
+	case c.in <- msg:
+	case <-c.done:
+	}
+}
+
+// shut reports end of input to the receiver of c.
+func (c *peerChannel) shut() { close(c.gone) }
+
+// Send implements part of the channel.Channel interface.
+func (c *peerChannel) Send(msg []byte) error {
+	select {
+	case <-c.done:
+		return io.ErrClosedPipe
+	default:
+		return c.send(msg)
+	}
+}
+
+// Recv implements part of the channel.Channel interface.
+func (c *peerChannel) Recv() ([]byte, error) {
+	select {
+	case msg := <-c.in:
+		return msg, nil
+	case <-c.gone:
+		return nil, io.EOF
+	case <-c.done:
+		return nil, io.EOF
+	}
+}
+
+// Close implements part of the channel.Channel interface. Closing c does not
+// close the underlying channel of the peer.
+func (c *peerChannel) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+
+	"bitbucket.org/creachadair/stringset"
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/code"
+	"github.com/herenow/jrpc2/fanout"
+)
+
+// A Fanout is a JSON-RPC proxy that forwards each request to all of several
+// backends concurrently, and combines their replies according to a
+// fanout.Strategy. It implements the jrpc2.Assigner interface. Notifications
+// are forwarded to every backend.
+//
+// If the combined call fails because of errors from the backends, the error
+// reported to the client has the code of the first of those errors, and its
+// data is an array of objects giving the name of each failed backend and its
+// error code and message.
+type Fanout struct {
+	backends []fanout.Backend
+	strategy fanout.Strategy
+	ps       []*Proxy // ps[i] forwards to backends[i].Client
+}
+
+// NewFanout creates a proxy that forwards requests to all the given backends,
+// and combines their replies using s. The options apply to each backend, save
+// that notifications are not relayed. If opts == nil, default options are
+// used. It reports an error if any of the glob patterns in opts is malformed.
+func NewFanout(backends []fanout.Backend, s fanout.Strategy, opts *Options) (*Fanout, error) {
+	if err := opts.filter().check(); err != nil {
+		return nil, err
+	}
+	f := &Fanout{backends: backends, strategy: s}
+	for _, b := range backends {
+		f.ps = append(f.ps, newProxy(b.Client, opts))
+	}
+	return f, nil
+}
+
+// Close closes the clients for all the backends of f, and reports the first
+// error, if any.
+func (f *Fanout) Close() error {
+	var err error
+	for _, p := range f.ps {
+		if cerr := p.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Assign implements part of the jrpc2.Assigner interface.
+func (f *Fanout) Assign(method string) jrpc2.Handler {
+	if len(f.ps) == 0 {
+		return nil
+	}
+	// The options are the same for all the backends.
+	h, ok := f.ps[0].assign(method, method)
+	if !ok {
+		return nil
+	}
+	return fanoutHandler{f: f, method: h.method, fields: h.fields}
+}
+
+// Refresh fetches the method names and metrics of each backend immediately,
+// and reports the first error, if any.
+func (f *Fanout) Refresh(ctx context.Context) error { return refreshAll(ctx, f.ps) }
+
+// Names implements part of the jrpc2.Assigner interface. It returns the names
+// of the methods reported by any of the backends.
+func (f *Fanout) Names() []string {
+	names := stringset.New()
+	for _, p := range f.ps {
+		names.Add(p.Names()...)
+	}
+	return names.Elements()
+}
+
+// fanoutHandler forwards requests to all the backends of a Fanout, under the
+// rewritten method name.
+type fanoutHandler struct {
+	f      *Fanout
+	method string
+	fields map[string]interface{}
+}
+
+// Handle implements the jrpc2.Handler interface.
+func (h fanoutHandler) Handle(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+	msg := req.RawParams()
+	if len(h.fields) != 0 {
+		var err error
+		if msg, err = injectParams(msg, h.fields); err != nil {
+			return nil, err
+		}
+	}
+	var params interface{}
+	if msg != nil {
+		params = msg
+	}
+
+	if req.IsNotification() {
+		var err error
+		for _, b := range h.f.backends {
+			if nerr := b.Client.Notify(ctx, h.method, params); err == nil && nerr != nil {
+				err = &fanout.Error{Name: b.Name, Err: nerr}
+			}
+		}
+		return nil, err
+	}
+
+	result, err := fanout.Call(ctx, h.f.backends, h.method, params, h.f.strategy)
+	var errs fanout.Errors
+	if errors.As(err, &errs) {
+		return nil, backendError(err, errs)
+	}
+	return result, err
+}
+
+// backendError converts err, caused by the given backend errors, into a
+// *jrpc2.Error that reports them.
+func backendError(err error, errs fanout.Errors) error {
+	type failure struct {
+		Backend string    `json:"backend"`
+		Code    code.Code `json:"code"`
+		Message string    `json:"message"`
+	}
+	data := make([]failure, len(errs))
+	for i, e := range errs {
+		data[i] = failure{Backend: e.Name, Code: code.FromError(e.Err), Message: e.Err.Error()}
+		if je, ok := e.Err.(*jrpc2.Error); ok {
+			data[i].Message = je.Message()
+		}
+	}
+	return jrpc2.DataErrorf(data[0].Code, data, "%v", err)
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/code"
+	"github.com/herenow/jrpc2/fanout"
+	"github.com/herenow/jrpc2/server"
+)
+
+func TestFanout(t *testing.T) {
+	// Each backend returns its name from Name, and fails Fail with a code.
+	var backends []fanout.Backend
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		cli, wait := server.Local(jrpc2.MapAssigner{
+			"Name": jrpc2.NewHandler(func(context.Context) (string, error) { return name, nil }),
+			"Fail": jrpc2.NewHandler(func(context.Context) (string, error) {
+				return "", jrpc2.Errorf(code.Code(-29000), "failed %s", name)
+			}),
+		}, nil)
+		defer wait()
+		backends = append(backends, fanout.Backend{Name: name, Client: cli})
+	}
+	f, err := NewFanout(backends, fanout.All, nil)
+	if err != nil {
+		t.Fatalf("NewFanout: unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	local, cleanup := server.Local(f, nil)
+	defer cleanup()
+	defer local.Close()
+
+	ctx := context.Background()
+	var got []string
+	if err := local.CallResult(ctx, "Name", nil, &got); err != nil {
+		t.Fatalf("Call(Name): unexpected error: %v", err)
+	} else if s := strings.Join(got, ","); s != "a,b,c" {
+		t.Errorf("Call(Name): got %q, want %q", s, "a,b,c")
+	}
+
+	// The error from a failed backend is reported with its name.
+	_, err = local.Call(ctx, "Fail", nil)
+	e, ok := err.(*jrpc2.Error)
+	if !ok {
+		t.Fatalf("Call(Fail): got error %v, want *jrpc2.Error", err)
+	} else if e.Code() != -29000 {
+		t.Errorf("Call(Fail): got code %v, want -29000", e.Code())
+	}
+	var data []struct {
+		Backend string    `json:"backend"`
+		Code    code.Code `json:"code"`
+		Message string    `json:"message"`
+	}
+	if err := e.UnmarshalData(&data); err != nil {
+		t.Fatalf("UnmarshalData: unexpected error: %v", err)
+	} else if len(data) != 1 {
+		t.Fatalf("Error data: got %+v, want one failure", data)
+	} else if want := "failed " + data[0].Backend; data[0].Message != want || data[0].Code != -29000 {
+		t.Errorf("Error data: got %+v, want code -29000 and message %q", data[0], want)
+	}
+
+	if err := f.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: unexpected error: %v", err)
+	}
+	if got, want := strings.Join(f.Names(), ","), "Fail,Name"; got != want {
+		t.Errorf("Names: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"bitbucket.org/creachadair/stringset"
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/code"
+)
+
+// A filter holds the rules that restrict and modify the requests forwarded by
+// a proxy. The zero value forwards all requests unmodified.
+type filter struct {
+	allow, deny []string          // glob patterns for method names
+	rename      map[string]string // client name → backend name
+	inject      []Injection
+}
+
+// check reports an error if any of the glob patterns of f is malformed.
+func (f filter) check() error {
+	for _, pat := range f.allow {
+		if err := checkPattern("allow", pat); err != nil {
+			return err
+		}
+	}
+	for _, pat := range f.deny {
+		if err := checkPattern("deny", pat); err != nil {
+			return err
+		}
+	}
+	for _, inj := range f.inject {
+		if err := checkPattern("inject", inj.Pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPattern reports an error if pat is not a valid path.Match pattern. The
+// kind of pattern is used to describe it in the error.
+func checkPattern(kind, pat string) error {
+	if _, err := path.Match(pat, ""); err != nil {
+		return fmt.Errorf("invalid %s pattern %q: %v", kind, pat, err)
+	}
+	return nil
+}
+
+// matchAny reports whether name matches any of the glob patterns, which must
+// have been checked.
+func matchAny(patterns []string, name string) bool {
+	for _, pat := range patterns {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether clients may call method.
+func (f filter) allowed(method string) bool {
+	if len(f.allow) != 0 && !matchAny(f.allow, method) {
+		return false
+	}
+	return !matchAny(f.deny, method)
+}
+
+// fields returns the parameters to inject into requests for method, or nil if
+// there are none.
+func (f filter) fields(method string) map[string]interface{} {
+	var fields map[string]interface{}
+	for _, inj := range f.inject {
+		if ok, _ := path.Match(inj.Pattern, method); !ok {
+			continue
+		} else if fields == nil {
+			fields = make(map[string]interface{})
+		}
+		for key, val := range inj.Params {
+			fields[key] = val
+		}
+	}
+	return fields
+}
+
+// visible returns the names by which clients may call the given backend
+// methods. If unrewrite != nil, it maps each backend name to the name
+// requested by clients, and reports false if there is none. If owns != nil, it
+// reports whether the caller forwards a method name to this backend. A renamed
+// method is visible if the name it is renamed to is owned.
+func (f filter) visible(names []string, unrewrite func(string) (string, bool), owns func(string) bool) []string {
+	if unrewrite == nil {
+		unrewrite = func(name string) (string, bool) { return name, true }
+	}
+	if owns == nil {
+		owns = func(string) bool { return true }
+	}
+
+	out := stringset.New()
+	owned := stringset.New()
+	for _, name := range names {
+		if method, found := unrewrite(name); found && owns(method) {
+			owned.Add(method)
+			if f.allowed(method) {
+				out.Add(method)
+			}
+		}
+	}
+	for method, target := range f.rename {
+		if owned.Contains(target) && f.allowed(method) {
+			out.Add(method)
+		}
+	}
+	return out.Elements()
+}
+
+// injectParams returns params, which must be empty or a JSON object, with the
+// given fields added.
+func injectParams(params json.RawMessage, fields map[string]interface{}) (json.RawMessage, error) {
+	obj := make(map[string]json.RawMessage)
+	if len(params) != 0 {
+		if err := json.Unmarshal(params, &obj); err != nil {
+			return nil, jrpc2.Errorf(code.InvalidParams, "parameters must be an object")
+		} else if obj == nil {
+			obj = make(map[string]json.RawMessage) // params were null
+		}
+	}
+	for key, val := range fields {
+		bits, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		obj[key] = bits
+	}
+	return json.Marshal(obj)
+}
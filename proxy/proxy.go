@@ -1,78 +1,440 @@
 // Package proxy implements a transparent JSON-RPC proxy that dispatches to a
-// jrpc2.Client.
+// jrpc2.Client, and a Router that dispatches to several clients according to
+// the method name of each request.
+//
+// A proxy forwards each request to its backend with the context given to its
+// handler, so a call is cancelled on the backend when it is cancelled by the
+// frontend client. To propagate the deadlines and metadata encoded by package
+// jctx, set DecodeContext to jctx.Decode in the options of the frontend server
+// and EncodeContext to jctx.Encode in the options of the backend client.
 package proxy
 
 import (
 	"context"
 	"encoding/json"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/channel"
+	"github.com/herenow/jrpc2/metrics"
 )
 
-// New creates a proxy that dispatches inbound requests to the given client.
-// The resulting value satisfies the jrpc2.Assigner interface, allowing it to
-// be used as the assigner for a jrpc2.Server.
+// New creates a proxy that dispatches inbound requests to the given client,
+// with default options. The resulting value satisfies the jrpc2.Assigner
+// interface, allowing it to be used as the assigner for a jrpc2.Server.
 //
 // For example:
 //    cli := jrpc2.NewClient(ch, clientOpts)
 //    ...
-//    s := jrpc2.NewServer(proxy.New(cli), &jrpc2.ServerOptions{
-//        DisableBuiltin: true,  // disable the proxy's rpc.* handlers
-//    })
+//    s := jrpc2.NewServer(proxy.New(cli), nil)
 //
-func New(c *jrpc2.Client) *Proxy {
-	return &Proxy{h: handler{c}}
+// The built-in rpc.* methods of the frontend server are handled by the proxy
+// rather than forwarded, but the method names reported by rpc.serverInfo are
+// obtained from the backend (see Names).
+func New(c *jrpc2.Client) *Proxy { return newProxy(c, nil) }
+
+// NewWithOptions creates a proxy as New does, with the given options. If
+// opts == nil, default options are used. It reports an error if any of the
+// glob patterns in opts is malformed.
+func NewWithOptions(c *jrpc2.Client, opts *Options) (*Proxy, error) {
+	if err := opts.filter().check(); err != nil {
+		return nil, err
+	}
+	return newProxy(c, opts), nil
+}
+
+// newProxy creates a proxy for c with the given options, which the caller
+// must already have checked.
+func newProxy(c *jrpc2.Client, opts *Options) *Proxy {
+	p := &Proxy{
+		mode:    opts.notify(),
+		ttl:     opts.namesTTL(),
+		metrics: opts.metrics(),
+		prefix:  opts.metricsPrefix(),
+		f:       opts.filter(),
+		conns:   make(map[*jrpc2.Server]int),
+		counts:  make(map[string]int64),
+	}
+	p.h = handler{client: c, p: p}
+	return p
+}
+
+// NewClient creates a proxy that dispatches inbound requests to a new client
+// connected to the backend via ch, with the given client options. Unlike New,
+// NewClient arranges for server notifications from the backend to be relayed
+// to the frontend clients, as specified by opts.Notify. Any OnNotify callback
+// set in copts is replaced. It reports an error if any of the glob patterns
+// in opts is malformed.
+func NewClient(ch channel.Channel, copts *jrpc2.ClientOptions, opts *Options) (*Proxy, error) {
+	p, err := NewWithOptions(nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	var cfg jrpc2.ClientOptions
+	if copts != nil {
+		cfg = *copts
+	}
+	cfg.OnNotify = p.relay
+	p.h.client = jrpc2.NewClient(ch, &cfg)
+	return p, nil
+}
+
+// Options control the behaviour of a proxy created by NewWithOptions or
+// NewClient. A nil *Options provides sensible defaults.
+type Options struct {
+	// How to relay server notifications from the backend to the frontend
+	// clients. This requires that the proxy be constructed with NewClient,
+	// and that the frontend servers enable AllowPush. By default,
+	// notifications from the backend are discarded.
+	Notify NotifyMode
+
+	// How long the method names reported by the backend's rpc.serverInfo
+	// method are cached before they are fetched again. If zero, a default of
+	// one minute is used.
+	NamesTTL time.Duration
+
+	// If set, the metrics reported by the backend's rpc.serverInfo method are
+	// merged into this collector each time the proxy fetches them. Sharing it
+	// with the frontend servers lets their rpc.serverInfo report both.
+	Metrics *metrics.M
+
+	// The prefix added to the names of backend metrics merged into Metrics.
+	// If empty, "backend." is used.
+	MetricsPrefix string
+
+	// If non-empty, only methods whose names match at least one of these glob
+	// patterns are forwarded to the backend. The syntax is that of path.Match,
+	// so "*" does not match a "/" in a method name. Requests for other methods
+	// fail with code.MethodNotFound.
+	Allow []string
+
+	// Methods whose names match any of these glob patterns are not forwarded
+	// to the backend, even if they are allowed. The syntax is as for Allow: To
+	// deny both "admin.reset" and "admin/reset", for example, list both
+	// "admin*" and "admin*/*". Requests for these methods fail with
+	// code.MethodNotFound.
+	Deny []string
+
+	// Maps method names requested by clients to the names forwarded to the
+	// backend. Allow and Deny apply to the names requested by clients, and a
+	// backend method may still be requested by its own name if it is allowed.
+	// A Router routes and rewrites a renamed method by its new name, as if the
+	// client had requested that name.
+	Rename map[string]string
+
+	// Parameters to add to the requests forwarded to the backend. See the
+	// Injection type for details.
+	Inject []Injection
+}
+
+// An Injection sets fields in the parameters of the requests for each method
+// whose name matches Pattern, a glob with the syntax of path.Match. The values
+// in Params replace any fields of the same names sent by the client. If the
+// client sends no parameters, an object is created; if it sends an array, the
+// request fails with code.InvalidParams. When several injections match the
+// same method, they are applied in order.
+type Injection struct {
+	Pattern string
+	Params  map[string]interface{}
+}
+
+func (o *Options) notify() NotifyMode {
+	if o == nil {
+		return Discard
+	}
+	return o.Notify
 }
 
+func (o *Options) namesTTL() time.Duration {
+	if o == nil || o.NamesTTL <= 0 {
+		return time.Minute
+	}
+	return o.NamesTTL
+}
+
+func (o *Options) metrics() *metrics.M {
+	if o == nil {
+		return nil
+	}
+	return o.Metrics
+}
+
+func (o *Options) filter() filter {
+	if o == nil {
+		return filter{}
+	}
+	return filter{allow: o.Allow, deny: o.Deny, rename: o.Rename, inject: o.Inject}
+}
+
+func (o *Options) metricsPrefix() string {
+	if o == nil || o.MetricsPrefix == "" {
+		return "backend."
+	}
+	return o.MetricsPrefix
+}
+
+// NotifyMode selects how a proxy relays server notifications from its
+// backend to its frontend clients.
+type NotifyMode int
+
+const (
+	// Discard drops all notifications from the backend.
+	Discard NotifyMode = iota
+
+	// Broadcast relays each notification to every frontend connection that
+	// has sent the proxy a request.
+	Broadcast
+
+	// Route relays each notification to the frontend connections that have a
+	// call in progress on the backend when it arrives. This is accurate when
+	// the backend pushes notifications only while handling a request. If no
+	// calls are in progress, the notification goes to the connection that
+	// sent the most recent request.
+	Route
+)
+
 // A Proxy is a JSON-RPC transparent proxy. It implements a jrpc2.Assigner that
 // assigns each requested method to a handler that forwards the request to a
 // server connected through a *jrpc2.Client.
-type Proxy struct{ h handler }
+type Proxy struct {
+	h       handler
+	mode    NotifyMode
+	ttl     time.Duration
+	metrics *metrics.M
+	prefix  string
+	f       filter
+
+	mu    sync.Mutex
+	conns map[*jrpc2.Server]int // frontend connections → calls in progress
+	last  *jrpc2.Server         // the connection that sent the latest request
+
+	imu        sync.Mutex // protects the fields below
+	names      []string   // method names reported by the backend
+	fetched    time.Time  // when names was last fetched
+	refreshing bool       // a background refresh is in progress
+
+	fmu    sync.Mutex       // serializes fetches from the backend; protects counts
+	counts map[string]int64 // backend counter values already merged
+}
 
 // Close closes the underlying client for p and reports its result.
 func (p *Proxy) Close() error { return p.h.client.Close() }
 
-// Assign implements part of the jrpc2.Assigner interface. All methods are
-// assigned to the proxy's internal handler, which forwards them across the
-// client.
-func (p *Proxy) Assign(_ string) jrpc2.Handler { return p.h }
+// Assign implements part of the jrpc2.Assigner interface. All the methods
+// permitted by the options of p are assigned to a handler that forwards them
+// across the client.
+func (p *Proxy) Assign(method string) jrpc2.Handler {
+	if h, ok := p.assign(method, method); ok {
+		return h
+	}
+	return nil
+}
 
-// Names implements part of the jrpc2.Assigner interface.  It always returns
-// nil, since the resolution of method names is delegated to the remote server.
-func (Proxy) Names() []string { return nil }
+// assign returns a handler that forwards requests for method to the backend
+// under the name target, applying the options of p. It reports false if the
+// method is not permitted.
+func (p *Proxy) assign(method, target string) (routeHandler, bool) {
+	if !p.f.allowed(method) {
+		return routeHandler{}, false
+	}
+	if name, ok := p.f.rename[method]; ok {
+		target = name
+	}
+	return routeHandler{h: p.h, method: target, fields: p.f.fields(method)}, true
+}
 
-type handler struct{ client *jrpc2.Client }
+// Names implements part of the jrpc2.Assigner interface. It returns the names
+// of the methods reported by the backend's rpc.serverInfo method that clients
+// are permitted to call, including the names of renamed methods.
+//
+// The backend's methods are cached for the duration of the NamesTTL option.
+// Names never waits for the backend: If the cache has expired, Names returns
+// the cached methods and refreshes them in the background. Until the first
+// refresh completes, Names reports no methods; call Refresh to fetch them
+// eagerly. If the backend cannot report its methods, Names uses the methods
+// last fetched, if any.
+func (p *Proxy) Names() []string {
+	return p.f.visible(p.backendNames(), nil, nil)
+}
+
+// backendNames returns the cached method names reported by the backend, and
+// starts a background refresh if they have expired.
+func (p *Proxy) backendNames() []string {
+	p.imu.Lock()
+	defer p.imu.Unlock()
+	if time.Since(p.fetched) >= p.ttl && !p.refreshing {
+		p.refreshing = true
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+			defer cancel()
+			p.Refresh(ctx)
+
+			p.imu.Lock()
+			defer p.imu.Unlock()
+			p.refreshing = false
+		}()
+	}
+	return p.names
+}
+
+// refreshTimeout bounds the time a background refresh waits for the backend.
+const refreshTimeout = 5 * time.Second
+
+// Refresh fetches the method names and metrics of the backend immediately,
+// regardless of whether the cached names have expired. A failed fetch also
+// counts as a refresh, so that an unresponsive backend is not queried again
+// until the NamesTTL has elapsed.
+func (p *Proxy) Refresh(ctx context.Context) error {
+	p.fmu.Lock()
+	defer p.fmu.Unlock()
+
+	// N.B. Do not hold p.imu during the call, so that Names does not wait.
+	var info jrpc2.ServerInfo
+	err := p.h.client.CallResult(ctx, "rpc.serverInfo", nil, &info)
+	if err == nil {
+		sort.Strings(info.Methods)
+	}
+	p.imu.Lock()
+	p.fetched = time.Now()
+	if err == nil {
+		p.names = info.Methods
+	}
+	p.imu.Unlock()
+	if err != nil {
+		return err
+	}
+	p.merge(&info)
+	return nil
+}
+
+// merge adds the backend metrics reported in info to the metrics of p, if
+// enabled. The caller must hold p.fmu.
+func (p *Proxy) merge(info *jrpc2.ServerInfo) {
+	if p.metrics == nil {
+		return
+	}
+	// The collector only supports adding to counters, so merge the change in
+	// each backend counter since the last fetch. A counter that has decreased
+	// was reset, for example because the backend restarted, so its whole
+	// value is new.
+	for name, n := range info.Counter {
+		delta := n - p.counts[name]
+		if delta < 0 {
+			delta = n
+		}
+		p.metrics.Count(p.prefix+name, delta)
+		p.counts[name] = n
+	}
+	for name, n := range info.MaxValue {
+		p.metrics.SetMaxValue(p.prefix+name, n)
+	}
+}
+
+// enter records that srv has a call in progress, and returns a function that
+// records its completion. If notifications are not relayed, enter does
+// nothing.
+func (p *Proxy) enter(srv *jrpc2.Server) func() {
+	if p.mode == Discard || srv == nil {
+		return func() {}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.conns[srv]; !ok {
+		go func() {
+			<-srv.Done() // N.B. not Wait, which belongs to the owner of srv
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			delete(p.conns, srv)
+			if p.last == srv {
+				p.last = nil
+			}
+		}()
+	}
+	p.conns[srv]++
+	p.last = srv
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.conns[srv]; ok {
+			p.conns[srv]--
+		}
+	}
+}
+
+// relay forwards a server notification from the backend to the frontend
+// connections selected by the notification mode.
+func (p *Proxy) relay(req *jrpc2.Request) {
+	var params json.RawMessage
+	if req.HasParams() {
+		if err := req.UnmarshalParams(&params); err != nil {
+			return
+		}
+	}
+	var targets []*jrpc2.Server
+	p.mu.Lock()
+	for srv, n := range p.conns {
+		if p.mode == Broadcast || n > 0 {
+			targets = append(targets, srv)
+		}
+	}
+	if len(targets) == 0 && p.mode == Route && p.last != nil {
+		targets = append(targets, p.last)
+	}
+	p.mu.Unlock()
+
+	for _, srv := range targets {
+		// Errors are ignored: A connection that has closed will be removed
+		// when its server exits.
+		srv.Push(context.Background(), req.Method(), params)
+	}
+}
+
+type handler struct {
+	client *jrpc2.Client
+	p      *Proxy
+}
 
 // Handle implements the jrpc2.Handler interface. It handles any call or
 // notification method name given, by forwarding it transparently to the remote
 // server. The only errors returned from the proxy itself are decoding errors,
 // or errors from the internals of the client's Call and Notify methods.
 func (h handler) Handle(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
-	// If the request has parameters, unpack them so we can pass them to the call.
-	var params interface{}
-	if req.HasParams() {
-		var msg json.RawMessage
-		if err := req.UnmarshalParams(&msg); err != nil {
+	return h.forward(ctx, req.Method(), nil, req)
+}
+
+// forward forwards req to the remote server as a call or notification of the
+// given method, which need not be the method named by req. If fields is not
+// empty, they are injected into the parameters.
+func (h handler) forward(ctx context.Context, method string, fields map[string]interface{}, req *jrpc2.Request) (interface{}, error) {
+	// The parameters and result are passed through as encoded, so that their
+	// contents are forwarded exactly and need not be decoded.
+	msg := req.RawParams()
+	if len(fields) != 0 {
+		var err error
+		if msg, err = injectParams(msg, fields); err != nil {
 			return nil, err
 		}
+	}
+	var params interface{}
+	if msg != nil {
 		params = msg
 	}
+	defer h.p.enter(jrpc2.ActiveServer(ctx))()
 
 	// If the request is a notification, do not block for a response.
 	if req.IsNotification() {
-		return nil, h.client.Notify(ctx, req.Method(), params)
+		return nil, h.client.Notify(ctx, method, params)
 	}
 
 	// Invoke the requested method on the proxied server.
-	rsp, err := h.client.Call(ctx, req.Method(), params)
+	rsp, err := h.client.Call(ctx, method, params)
 	if err != nil {
 		return nil, err
 	}
-
-	// Extract the response value or error.
-	var result json.RawMessage
-	if err := rsp.UnmarshalResult(&result); err != nil {
-		return nil, err
+	if raw := rsp.RawResult(); len(raw) != 0 {
+		return raw, nil
 	}
-	return result, nil
+	return json.RawMessage("null"), nil
 }
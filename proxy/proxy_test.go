@@ -2,9 +2,17 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/caller"
+	"github.com/herenow/jrpc2/channel"
+	"github.com/herenow/jrpc2/code"
+	"github.com/herenow/jrpc2/jctx"
+	"github.com/herenow/jrpc2/metrics"
 	"github.com/herenow/jrpc2/server"
 )
 
@@ -41,3 +49,452 @@ func TestProxy(t *testing.T) {
 		t.Errorf("Call(Test): got %q, want %q", got, remoteAnswer)
 	}
 }
+
+func TestNotify(t *testing.T) {
+	tests := []struct {
+		mode         NotifyMode
+		wantA, wantB bool // whether each frontend should see the notification
+	}{
+		{Discard, false, false},
+		{Broadcast, true, true},
+		{Route, true, false},
+	}
+	for _, test := range tests {
+		// Set up a "remote" server whose Poke method pushes a notification.
+		cpipe, spipe := channel.Pipe(channel.Varint)
+		remote := jrpc2.NewServer(jrpc2.MapAssigner{
+			"Poke": jrpc2.NewHandler(func(ctx context.Context) (bool, error) {
+				return true, jrpc2.ServerPush(ctx, "Poked", []string{"hey"})
+			}),
+			"Nop": jrpc2.NewHandler(func(context.Context) (bool, error) { return true, nil }),
+		}, &jrpc2.ServerOptions{AllowPush: true}).Start(spipe)
+		pc, err := NewClient(cpipe, nil, &Options{Notify: test.mode})
+		if err != nil {
+			t.Fatalf("NewClient: unexpected error: %v", err)
+		}
+
+		// Connect two frontend clients to the proxy, recording notifications.
+		newLocal := func() (*jrpc2.Client, func() error, chan string) {
+			notes := make(chan string, 4)
+			cli, wait := server.Local(pc, &server.LocalOptions{
+				ServerOptions: &jrpc2.ServerOptions{AllowPush: true, DisableBuiltin: true},
+				ClientOptions: &jrpc2.ClientOptions{
+					OnNotify: func(req *jrpc2.Request) { notes <- req.Method() },
+				},
+			})
+			return cli, wait, notes
+		}
+		a, waitA, notesA := newLocal()
+		b, waitB, notesB := newLocal()
+
+		ctx := context.Background()
+		for _, cli := range []*jrpc2.Client{a, b} {
+			if _, err := cli.Call(ctx, "Nop", nil); err != nil {
+				t.Fatalf("Call(Nop): unexpected error: %v", err)
+			}
+		}
+		if _, err := a.Call(ctx, "Poke", nil); err != nil {
+			t.Fatalf("Call(Poke): unexpected error: %v", err)
+		}
+
+		// A round trip on each connection ensures that any notification sent
+		// before it has been delivered.
+		for i, c := range []struct {
+			cli   *jrpc2.Client
+			notes chan string
+			want  bool
+		}{{a, notesA, test.wantA}, {b, notesB, test.wantB}} {
+			if _, err := c.cli.Call(ctx, "Nop", nil); err != nil {
+				t.Fatalf("Call(Nop): unexpected error: %v", err)
+			}
+			select {
+			case m := <-c.notes:
+				if !c.want {
+					t.Errorf("Mode %v client %d: unexpected notification %q", test.mode, i, m)
+				}
+			default:
+				if c.want {
+					t.Errorf("Mode %v client %d: missing notification", test.mode, i)
+				}
+			}
+		}
+
+		a.Close()
+		b.Close()
+		waitA()
+		waitB()
+		pc.Close()
+		remote.Wait()
+	}
+}
+
+func TestServerInfo(t *testing.T) {
+	// Set up a "remote" server with some methods and its own metrics.
+	rm := metrics.New()
+	remote, cleanup := server.Local(jrpc2.MapAssigner{
+		"Alpha": jrpc2.NewHandler(func(context.Context) (bool, error) { return true, nil }),
+		"Bravo": jrpc2.NewHandler(func(context.Context) (bool, error) { return true, nil }),
+	}, &server.LocalOptions{
+		ServerOptions: &jrpc2.ServerOptions{Metrics: rm},
+	})
+	defer cleanup()
+	defer remote.Close()
+
+	// Set up a proxy whose frontend enables the built-in methods, and shares
+	// its metrics collector with the proxy.
+	lm := metrics.New()
+	p, err := NewWithOptions(remote, &Options{NamesTTL: time.Hour, Metrics: lm})
+	if err != nil {
+		t.Fatalf("NewWithOptions: unexpected error: %v", err)
+	}
+	local, cleanup := server.Local(p, &server.LocalOptions{
+		ServerOptions: &jrpc2.ServerOptions{Metrics: lm},
+	})
+	defer cleanup()
+	defer local.Close()
+
+	ctx := context.Background()
+	if _, err := local.Call(ctx, "Alpha", nil); err != nil {
+		t.Fatalf("Call(Alpha): unexpected error: %v", err)
+	}
+	if err := p.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: unexpected error: %v", err)
+	}
+	info, err := caller.RPCServerInfo(ctx, local)
+	if err != nil {
+		t.Fatalf("rpc.serverInfo: unexpected error: %v", err)
+	}
+	if got, want := strings.Join(info.Methods, ","), "Alpha,Bravo"; got != want {
+		t.Errorf("Methods: got %q, want %q", got, want)
+	}
+
+	// Both the backend and the frontend have seen two requests: Alpha, and
+	// their own rpc.serverInfo. The frontend used the names fetched by
+	// Refresh, without querying the backend again.
+	if got := info.Counter["backend.rpc.requests"]; got != 2 {
+		t.Errorf("backend.rpc.requests: got %d, want 2", got)
+	}
+	if got := info.Counter["rpc.requests"]; got != 2 {
+		t.Errorf("rpc.requests: got %d, want 2", got)
+	}
+
+	// Within the TTL, the names are served from the cache without another
+	// call to the backend.
+	requests := func(m *metrics.M) int64 {
+		counts := make(map[string]int64)
+		m.Snapshot(metrics.Snapshot{Counter: counts})
+		return counts["rpc.requests"]
+	}
+	before := requests(rm)
+	p.Names()
+	if after := requests(rm); after != before {
+		t.Errorf("Names: backend was queried again within the TTL (%d requests, was %d)", after, before)
+	}
+
+	// Refresh merges the change in the backend counters.
+	if err := p.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: unexpected error: %v", err)
+	}
+	counts := make(map[string]int64)
+	lm.Snapshot(metrics.Snapshot{Counter: counts})
+	if got := counts["backend.rpc.requests"]; got != 3 {
+		t.Errorf("After Refresh: backend.rpc.requests: got %d, want 3", got)
+	}
+}
+
+func TestNamesUnresponsive(t *testing.T) {
+	// Set up a backend client whose server reads requests but never answers.
+	cch, sch := channel.Pipe(channel.Line)
+	go func() {
+		for {
+			if _, err := sch.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+	p := New(jrpc2.NewClient(cch, nil))
+	defer p.Close()
+	defer sch.Close()
+
+	// Names does not wait for the backend.
+	done := make(chan []string, 1)
+	go func() { done <- p.Names() }()
+	select {
+	case names := <-done:
+		if len(names) != 0 {
+			t.Errorf("Names: got %+q, want none", names)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Names blocked on an unresponsive backend")
+	}
+}
+
+func TestMergeReset(t *testing.T) {
+	lm := metrics.New()
+	p := newProxy(nil, &Options{Metrics: lm})
+	counter := func() int64 {
+		counts := make(map[string]int64)
+		lm.Snapshot(metrics.Snapshot{Counter: counts})
+		return counts["backend.rpc.requests"]
+	}
+	tests := []struct {
+		backend, want int64
+	}{
+		{5, 5},
+		{8, 8},
+		{2, 10}, // the backend restarted, so all of its count is new
+		{3, 11},
+	}
+	for _, test := range tests {
+		p.merge(&jrpc2.ServerInfo{Counter: map[string]int64{"rpc.requests": test.backend}})
+		if got := counter(); got != test.want {
+			t.Errorf("After backend count %d: got %d, want %d", test.backend, got, test.want)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	// Set up a "remote" server whose methods echo their name and parameters.
+	echo := jrpc2.NewHandler(func(_ context.Context, req *jrpc2.Request) (string, error) {
+		var params json.RawMessage
+		if req.HasParams() {
+			if err := req.UnmarshalParams(&params); err != nil {
+				return "", err
+			}
+		}
+		return req.Method() + " " + string(params), nil
+	})
+	remote, cleanup := server.Local(jrpc2.MapAssigner{
+		"Public.Get":    echo,
+		"Public.Put":    echo,
+		"Public.Delete": echo,
+		"Private.Get":   echo,
+		"Tenant.Query":  echo,
+	}, nil)
+	defer cleanup()
+	defer remote.Close()
+
+	p, err := NewWithOptions(remote, &Options{
+		Allow:  []string{"Public.*", "Tenant.*", "Query"},
+		Deny:   []string{"*.Delete"},
+		Rename: map[string]string{"Query": "Tenant.Query"},
+		Inject: []Injection{
+			{Pattern: "Tenant.*", Params: map[string]interface{}{"tenant": "acme"}},
+			{Pattern: "Query", Params: map[string]interface{}{"tenant": "acme"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewWithOptions: unexpected error: %v", err)
+	}
+	local, cleanup := server.Local(p, nil)
+	defer cleanup()
+	defer local.Close()
+
+	ctx := context.Background()
+	tests := []struct {
+		method string
+		params interface{}
+		want   string
+	}{
+		{"Public.Get", []int{1, 2}, "Public.Get [1,2]"},
+		{"Public.Put", nil, "Public.Put "},
+		{"Tenant.Query", nil, `Tenant.Query {"tenant":"acme"}`},
+		{"Tenant.Query", map[string]interface{}{"tenant": "evil", "n": 5}, `Tenant.Query {"n":5,"tenant":"acme"}`},
+		{"Query", map[string]int{"n": 12345678901234567}, `Tenant.Query {"n":12345678901234567,"tenant":"acme"}`},
+	}
+	for _, test := range tests {
+		var got string
+		if err := local.CallResult(ctx, test.method, test.params, &got); err != nil {
+			t.Errorf("Call(%q): unexpected error: %v", test.method, err)
+		} else if got != test.want {
+			t.Errorf("Call(%q): got %#q, want %#q", test.method, got, test.want)
+		}
+	}
+
+	// Denied methods, and those not allowed, are not found.
+	for _, method := range []string{"Public.Delete", "Private.Get", "Other"} {
+		_, err := local.Call(ctx, method, nil)
+		if got := code.FromError(err); got != code.MethodNotFound {
+			t.Errorf("Call(%q): got error %v, want %v", method, err, code.MethodNotFound)
+		}
+	}
+
+	// Parameters cannot be injected into an array.
+	_, err = local.Call(ctx, "Tenant.Query", []int{1})
+	if got := code.FromError(err); got != code.InvalidParams {
+		t.Errorf("Call(Tenant.Query): got error %v, want %v", err, code.InvalidParams)
+	}
+
+	// Only the permitted methods are reported.
+	if err := p.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: unexpected error: %v", err)
+	}
+	info, err := caller.RPCServerInfo(ctx, local)
+	if err != nil {
+		t.Fatalf("rpc.serverInfo: unexpected error: %v", err)
+	}
+	const want = "Public.Get,Public.Put,Query,Tenant.Query"
+	if got := strings.Join(info.Methods, ","); got != want {
+		t.Errorf("Methods: got %q, want %q", got, want)
+	}
+}
+
+func TestBadPatterns(t *testing.T) {
+	tests := []*Options{
+		{Allow: []string{"Public.*", "Admin.["}},
+		{Deny: []string{"Admin.["}},
+		{Inject: []Injection{{Pattern: "[", Params: map[string]interface{}{"x": 1}}}},
+	}
+	for _, opts := range tests {
+		if p, err := NewWithOptions(nil, opts); err == nil {
+			t.Errorf("NewWithOptions(%+v): got %v, want error", opts, p)
+		}
+		if r, err := NewRouter(nil, opts); err == nil {
+			t.Errorf("NewRouter(%+v): got %v, want error", opts, r)
+		}
+	}
+	if r, err := NewRouter([]Rule{{Pattern: "Store.["}}, nil); err == nil {
+		t.Errorf("NewRouter with a bad rule pattern: got %v, want error", r)
+	}
+}
+
+func TestContext(t *testing.T) {
+	// Set up a "remote" server that reports the deadline and metadata of each
+	// request, or waits to be cancelled.
+	type report struct {
+		Deadline time.Time
+		Meta     string
+	}
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	remote, cleanup := server.Local(jrpc2.MapAssigner{
+		"Report": jrpc2.NewHandler(func(ctx context.Context) (report, error) {
+			var rep report
+			rep.Deadline, _ = ctx.Deadline()
+			jctx.UnmarshalMetadata(ctx, &rep.Meta)
+			return rep, nil
+		}),
+		"Wait": jrpc2.NewHandler(func(ctx context.Context) (bool, error) {
+			close(started)
+			<-ctx.Done()
+			close(cancelled)
+			return false, ctx.Err()
+		}),
+	}, &server.LocalOptions{
+		ServerOptions: &jrpc2.ServerOptions{DecodeContext: jctx.Decode},
+		ClientOptions: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
+	})
+	defer cleanup()
+	defer remote.Close()
+
+	local, cleanup := server.Local(New(remote), &server.LocalOptions{
+		ServerOptions: &jrpc2.ServerOptions{DecodeContext: jctx.Decode},
+		ClientOptions: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
+	})
+	defer cleanup()
+	defer local.Close()
+
+	// The deadline and metadata of the caller reach the remote server.
+	deadline := time.Now().Add(time.Hour).Round(time.Second).UTC()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	ctx, err := jctx.WithMetadata(ctx, "hello")
+	if err != nil {
+		t.Fatalf("WithMetadata: %v", err)
+	}
+	var got report
+	if err := local.CallResult(ctx, "Report", nil, &got); err != nil {
+		t.Fatalf("Call(Report): unexpected error: %v", err)
+	}
+	if !got.Deadline.Equal(deadline) {
+		t.Errorf("Deadline: got %v, want %v", got.Deadline, deadline)
+	}
+	if got.Meta != "hello" {
+		t.Errorf("Metadata: got %q, want %q", got.Meta, "hello")
+	}
+
+	// Cancelling a call cancels it on the remote server.
+	ctx, cancel = context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := local.Call(ctx, "Wait", nil)
+		errc <- err
+	}()
+	<-started
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Call(Wait) was not cancelled on the remote server")
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Call(Wait): got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	// Set up a "remote" server that returns its parameters unmodified.
+	remote, cleanup := server.Local(jrpc2.MapAssigner{
+		"Echo": jrpc2.NewHandler(func(_ context.Context, req *jrpc2.Request) (json.RawMessage, error) {
+			return req.RawParams(), nil
+		}),
+	}, nil)
+	defer cleanup()
+	defer remote.Close()
+
+	local, cleanup := server.Local(New(remote), nil)
+	defer cleanup()
+	defer local.Close()
+
+	// The encoded params and result are forwarded without being decoded and
+	// encoded again, which saves time and allocations in the proxy. The bytes
+	// arrive as they were sent, apart from insignificant whitespace.
+	const params = `{"z": 123456789012345678901234567890, "a": [1.50, 2e3], "m": {"b": 1, "a": 2}}`
+	const want = `{"z":123456789012345678901234567890,"a":[1.50,2e3],"m":{"b":1,"a":2}}`
+	rsp, err := local.Call(context.Background(), "Echo", json.RawMessage(params))
+	if err != nil {
+		t.Fatalf("Call(Echo): unexpected error: %v", err)
+	}
+	if got := string(rsp.RawResult()); got != want {
+		t.Errorf("Call(Echo): got %#q, want %#q", got, want)
+	}
+	// An empty result is forwarded as null, so the reply still has a result.
+	rsp, err = local.Call(context.Background(), "Echo", nil)
+	if err != nil {
+		t.Fatalf("Call(Echo): unexpected error: %v", err)
+	}
+	if got := string(rsp.RawResult()); got != "null" {
+		t.Errorf("Call(Echo) without params: got %#q, want null", got)
+	}
+}
+
+func BenchmarkProxy(b *testing.B) {
+	// Set up a "remote" server that returns its parameters unmodified.
+	remote, cleanup := server.Local(jrpc2.MapAssigner{
+		"Echo": jrpc2.NewHandler(func(_ context.Context, req *jrpc2.Request) (json.RawMessage, error) {
+			return req.RawParams(), nil
+		}),
+	}, nil)
+	defer cleanup()
+	defer remote.Close()
+
+	local, cleanup := server.Local(New(remote), nil)
+	defer cleanup()
+	defer local.Close()
+
+	items := make([]map[string]interface{}, 100)
+	for i := range items {
+		items[i] = map[string]interface{}{"id": i, "name": "item", "tags": []string{"a", "b", "c"}}
+	}
+	params, err := json.Marshal(map[string]interface{}{"items": items})
+	if err != nil {
+		b.Fatalf("Marshal: %v", err)
+	}
+	ctx := context.Background()
+	b.SetBytes(int64(len(params)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := local.Call(ctx, "Echo", json.RawMessage(params)); err != nil {
+			b.Fatalf("Call(Echo): %v", err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/creachadair/stringset"
+	"github.com/herenow/jrpc2"
+)
+
+// A Rule associates a set of method names with a backend client. A rule
+// matches a method name if the name has the given Prefix and matches the
+// given Pattern; an empty Prefix or Pattern matches any name.
+type Rule struct {
+	// Methods whose names begin with this prefix match the route.
+	Prefix string
+
+	// Methods whose names match this glob pattern match the route. The syntax
+	// is that of path.Match, so "*" does not match a "/" in a method name.
+	Pattern string
+
+	// The client connected to the backend for the route.
+	Client *jrpc2.Client
+
+	// If positive, calls forwarded by this rule fail if the backend has not
+	// replied within this duration.
+	Timeout time.Duration
+
+	// If true, Prefix is removed from each method name before the request is
+	// forwarded to the backend.
+	StripPrefix bool
+
+	// If set, this prefix is added to each method name before the request is
+	// forwarded to the backend, after StripPrefix is applied.
+	AddPrefix string
+}
+
+func (r *Rule) matches(method string) bool {
+	if !strings.HasPrefix(method, r.Prefix) {
+		return false
+	}
+	if r.Pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Pattern, method)
+	return ok
+}
+
+// rewrite returns the name under which method is forwarded to the backend.
+func (r *Rule) rewrite(method string) string {
+	if r.StripPrefix {
+		method = strings.TrimPrefix(method, r.Prefix)
+	}
+	return r.AddPrefix + method
+}
+
+// unrewrite returns the method name that is rewritten to the given backend
+// name, and reports whether there is one.
+func (r *Rule) unrewrite(name string) (string, bool) {
+	if !strings.HasPrefix(name, r.AddPrefix) {
+		return "", false
+	}
+	name = strings.TrimPrefix(name, r.AddPrefix)
+	if r.StripPrefix {
+		name = r.Prefix + name
+	}
+	return name, true
+}
+
+// A Router is a JSON-RPC proxy that forwards each request to one of several
+// backends, chosen by the method name of the request. It implements the
+// jrpc2.Assigner interface. Requests for methods that match no rule fail with
+// code.MethodNotFound.
+//
+// For example:
+//    r, err := proxy.NewRouter([]proxy.Rule{
+//        {Prefix: "Math.", Client: mathClient},
+//        {Prefix: "Store.", Client: storeClient, StripPrefix: true},
+//    }, nil)
+//    ...
+//    s := jrpc2.NewServer(r, nil)
+//
+type Router struct {
+	rules []Rule
+	f     filter
+	ps    []*Proxy // ps[i] forwards to rules[i].Client
+}
+
+// NewRouter creates a router that dispatches requests according to the given
+// rules. The rules are tried in order, and each request is forwarded to the
+// backend of the first rule that matches its method name. The options apply to
+// each backend, save that notifications are not relayed. If opts == nil,
+// default options are used. It reports an error if the pattern of any rule, or
+// any of the glob patterns in opts, is malformed.
+func NewRouter(rules []Rule, opts *Options) (*Router, error) {
+	if err := opts.filter().check(); err != nil {
+		return nil, err
+	}
+	r := &Router{rules: rules, f: opts.filter()}
+	for i, rule := range rules {
+		if rule.Pattern != "" {
+			if err := checkPattern(fmt.Sprintf("rule %d", i+1), rule.Pattern); err != nil {
+				return nil, err
+			}
+		}
+		r.ps = append(r.ps, newProxy(rule.Client, opts))
+	}
+	return r, nil
+}
+
+// Close closes the clients for all the rules of r, and reports the first
+// error, if any.
+func (r *Router) Close() error {
+	var err error
+	for _, p := range r.ps {
+		if cerr := p.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// route returns the index of the first rule matching method, or -1.
+func (r *Router) route(method string) int {
+	for i := range r.rules {
+		if r.rules[i].matches(method) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Assign implements part of the jrpc2.Assigner interface. A method renamed by
+// the options is routed and rewritten by its new name.
+func (r *Router) Assign(method string) jrpc2.Handler {
+	if !r.f.allowed(method) {
+		return nil
+	}
+	name := method
+	if target, ok := r.f.rename[method]; ok {
+		name = target
+	}
+	i := r.route(name)
+	if i < 0 {
+		return nil
+	}
+	return routeHandler{
+		h:       r.ps[i].h,
+		method:  r.rules[i].rewrite(name),
+		fields:  r.f.fields(method),
+		timeout: r.rules[i].Timeout,
+	}
+}
+
+// Names implements part of the jrpc2.Assigner interface. It returns the names
+// of the methods reported by each backend, as they are known to the clients
+// of r, omitting those that would not be routed to that backend or that are
+// not permitted by the options.
+func (r *Router) Names() []string {
+	names := stringset.New()
+	for i, p := range r.ps {
+		i := i
+		names.Add(r.f.visible(p.backendNames(), r.rules[i].unrewrite, func(method string) bool {
+			return r.route(method) == i
+		})...)
+	}
+	return names.Elements()
+}
+
+// Refresh fetches the method names and metrics of each backend immediately,
+// and reports the first error, if any.
+func (r *Router) Refresh(ctx context.Context) error { return refreshAll(ctx, r.ps) }
+
+// refreshAll refreshes each of ps concurrently, and reports the first error in
+// the order of ps, if any.
+func refreshAll(ctx context.Context, ps []*Proxy) error {
+	errs := make([]error, len(ps))
+	var wg sync.WaitGroup
+	for i, p := range ps {
+		i, p := i, p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = p.Refresh(ctx)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeHandler forwards requests under a rewritten method name, with the
+// given fields injected into the parameters.
+type routeHandler struct {
+	h       handler
+	method  string
+	fields  map[string]interface{}
+	timeout time.Duration
+}
+
+// Handle implements the jrpc2.Handler interface.
+func (r routeHandler) Handle(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	return r.h.forward(ctx, r.method, r.fields, req)
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/code"
+	"github.com/herenow/jrpc2/server"
+)
+
+func TestRouter(t *testing.T) {
+	// Each backend reports its own name and the method it was called with.
+	newBackend := func(name string, methods ...string) (*jrpc2.Client, func() error) {
+		mux := make(jrpc2.MapAssigner)
+		for _, m := range methods {
+			mux[m] = jrpc2.NewHandler(func(ctx context.Context, req *jrpc2.Request) (string, error) {
+				if req.Method() == "x.Slow" {
+					<-ctx.Done()
+					return "", ctx.Err()
+				}
+				return name + ":" + req.Method(), nil
+			})
+		}
+		return server.Local(mux, nil)
+	}
+	a, waitA := newBackend("a", "Add", "Sub")
+	b, waitB := newBackend("b", "x.Store.Get", "x.Store.Put", "x.Slow", "Other")
+	defer func() {
+		waitA()
+		waitB()
+	}()
+
+	r, err := NewRouter([]Rule{
+		{Prefix: "Math.", Client: a, StripPrefix: true},
+		{Pattern: "Store.*", Client: b, AddPrefix: "x."},
+		{Pattern: "Slow", Client: b, AddPrefix: "x.", Timeout: 10 * time.Millisecond},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewRouter: unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	local, cleanup := server.Local(r, nil)
+	defer cleanup()
+	defer local.Close()
+
+	ctx := context.Background()
+	tests := []struct {
+		method, want string
+	}{
+		{"Math.Add", "a:Add"},
+		{"Math.Sub", "a:Sub"},
+		{"Store.Get", "b:x.Store.Get"},
+		{"Store.Put", "b:x.Store.Put"},
+	}
+	for _, test := range tests {
+		var got string
+		if err := local.CallResult(ctx, test.method, nil, &got); err != nil {
+			t.Errorf("Call(%q): unexpected error: %v", test.method, err)
+		} else if got != test.want {
+			t.Errorf("Call(%q): got %q, want %q", test.method, got, test.want)
+		}
+	}
+
+	// Methods that match no rule are not found, even if a backend has them.
+	for _, method := range []string{"Add", "Other", "Math"} {
+		_, err := local.Call(ctx, method, nil)
+		if got := code.FromError(err); got != code.MethodNotFound {
+			t.Errorf("Call(%q): got error %v, want %v", method, err, code.MethodNotFound)
+		}
+	}
+
+	// A rule with a timeout gives up on a slow backend.
+	if _, err := local.Call(ctx, "Slow", nil); err == nil {
+		t.Error("Call(Slow): got nil error, want timeout")
+	} else if got := code.FromError(err); got != code.DeadlineExceeded {
+		t.Errorf("Call(Slow): got error %v, want %v", err, code.DeadlineExceeded)
+	}
+
+	// The router reports the backend methods by the names its clients use.
+	if err := r.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: unexpected error: %v", err)
+	}
+	const wantNames = "Math.Add,Math.Sub,Slow,Store.Get,Store.Put"
+	if got := strings.Join(r.Names(), ","); got != wantNames {
+		t.Errorf("Names: got %q, want %q", got, wantNames)
+	}
+}
+
+func TestRouterRename(t *testing.T) {
+	echo := jrpc2.NewHandler(func(ctx context.Context, req *jrpc2.Request) (string, error) {
+		return req.Method(), nil
+	})
+	store, wait := server.Local(jrpc2.MapAssigner{"Get": echo, "Put": echo}, nil)
+	defer wait()
+
+	// The renamed method is routed and rewritten by its new name.
+	r, err := NewRouter([]Rule{
+		{Prefix: "Store.", Client: store, StripPrefix: true},
+	}, &Options{Rename: map[string]string{"Get": "Store.Get"}})
+	if err != nil {
+		t.Fatalf("NewRouter: unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	local, cleanup := server.Local(r, nil)
+	defer cleanup()
+	defer local.Close()
+
+	ctx := context.Background()
+	for _, method := range []string{"Get", "Store.Get"} {
+		var got string
+		if err := local.CallResult(ctx, method, nil, &got); err != nil {
+			t.Errorf("Call(%q): unexpected error: %v", method, err)
+		} else if got != "Get" {
+			t.Errorf("Call(%q): got %q, want Get", method, got)
+		}
+	}
+
+	if err := r.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: unexpected error: %v", err)
+	}
+	const wantNames = "Get,Store.Get,Store.Put"
+	if got := strings.Join(r.Names(), ","); got != wantNames {
+		t.Errorf("Names: got %q, want %q", got, wantNames)
+	}
+}
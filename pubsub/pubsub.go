@@ -0,0 +1,269 @@
+// Package pubsub implements a publish-subscribe framework on top of jrpc2
+// server notifications.
+//
+// A Hub keeps track of a set of named topics, and of the subscriptions that
+// clients have made to them. The Hub is a jrpc2.Assigner that exports two
+// methods, Subscribe and Unsubscribe, which are typically mounted under a
+// service name:
+//
+//    hub := pubsub.NewHub(nil)
+//    hub.AddTopic("news")
+//    srv := jrpc2.NewServer(jrpc2.ServiceMapper{
+//       "pubsub": hub,  // methods pubsub.Subscribe, pubsub.Unsubscribe
+//    }, &jrpc2.ServerOptions{AllowPush: true})
+//
+// Events published to a topic are sent as server notifications to each
+// connection that has subscribed to it. A single Hub may be shared by all the
+// servers started by server.Loop, and subscriptions are discarded when the
+// server for their connection exits. Server notifications are a non-standard
+// extension of JSON-RPC, so servers using a Hub must enable AllowPush.
+//
+// On the client side, a Subscriber receives event notifications and delivers
+// them on a channel for each subscription.
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"bitbucket.org/creachadair/stringset"
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/code"
+)
+
+// An Event is the parameter of a notification sent to a subscriber when a
+// value is published to a topic.
+type Event struct {
+	Subscription string          `json:"subscription"`
+	Topic        string          `json:"topic"`
+	Data         json.RawMessage `json:"data,omitempty"`
+}
+
+// UnmarshalData decodes the data associated with e into v.
+func (e *Event) UnmarshalData(v interface{}) error { return json.Unmarshal(e.Data, v) }
+
+// SubscribeRequest is the parameter of the Subscribe method.
+type SubscribeRequest struct {
+	Topic string `json:"topic"`
+}
+
+// UnsubscribeRequest is the parameter of the Unsubscribe method.
+type UnsubscribeRequest struct {
+	ID string `json:"id"`
+}
+
+// Options control the behaviour of a Hub or a Subscriber. A nil *Options
+// provides sensible defaults. A Hub and the Subscribers connected to it
+// should use the same options.
+type Options struct {
+	// The method name used for event notifications. If empty, "pubsub.event"
+	// is used.
+	Notify string
+
+	// The service name under which the Hub's methods are exported, used by
+	// the Subscriber to call them. If empty, "pubsub" is used, so that the
+	// methods are "pubsub.Subscribe" and "pubsub.Unsubscribe".
+	Service string
+}
+
+func (o *Options) notify() string {
+	if o == nil || o.Notify == "" {
+		return "pubsub.event"
+	}
+	return o.Notify
+}
+
+func (o *Options) method(name string) string {
+	if o == nil || o.Service == "" {
+		return "pubsub." + name
+	}
+	return o.Service + "." + name
+}
+
+// A Hub manages a set of topics and the subscriptions to them. It implements
+// the jrpc2.Assigner interface. A *Hub is safe for concurrent use by multiple
+// goroutines.
+type Hub struct {
+	notify string
+
+	mu     sync.Mutex
+	nextID int64
+	topics map[string]map[string]*sub        // subscriptions by topic and ID
+	subs   map[string]*sub                   // subscriptions by ID
+	conns  map[*jrpc2.Server]map[string]*sub // subscriptions by server and ID
+}
+
+type sub struct {
+	id, topic string
+	srv       *jrpc2.Server
+}
+
+// NewHub constructs a new Hub with no topics.
+func NewHub(opts *Options) *Hub {
+	return &Hub{
+		notify: opts.notify(),
+		topics: make(map[string]map[string]*sub),
+		subs:   make(map[string]*sub),
+		conns:  make(map[*jrpc2.Server]map[string]*sub),
+	}
+}
+
+// AddTopic adds a topic with the given name to h, if it is not already
+// present. Clients may only subscribe to topics that have been added.
+func (h *Hub) AddTopic(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.topics[name]; !ok {
+		h.topics[name] = make(map[string]*sub)
+	}
+}
+
+// RemoveTopic removes the named topic from h, and discards all the
+// subscriptions to it.
+func (h *Hub) RemoveTopic(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.topics[name] {
+		h.dropLocked(s)
+	}
+	delete(h.topics, name)
+}
+
+// Topics returns the names of the topics currently defined in h, in
+// lexicographic order.
+func (h *Hub) Topics() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return stringset.FromKeys(h.topics).Elements()
+}
+
+// Publish sends data to every subscriber of the named topic, and reports the
+// number of subscriptions to which it was delivered. It is an error if the
+// topic is not defined, or if data cannot be encoded as JSON. If a
+// notification cannot be sent because the server for its connection has
+// stopped, the subscriptions for that connection are discarded.
+func (h *Hub) Publish(ctx context.Context, topic string, data interface{}) (int, error) {
+	var bits json.RawMessage
+	if data != nil {
+		v, err := json.Marshal(data)
+		if err != nil {
+			return 0, err
+		}
+		bits = v
+	}
+
+	// Take a snapshot of the subscribers, so that we do not hold the lock
+	// while sending notifications.
+	h.mu.Lock()
+	subs, ok := h.topics[topic]
+	if !ok {
+		h.mu.Unlock()
+		return 0, fmt.Errorf("unknown topic %q", topic)
+	}
+	targets := make([]*sub, 0, len(subs))
+	for _, s := range subs {
+		targets = append(targets, s)
+	}
+	h.mu.Unlock()
+
+	var nsent int
+	for _, s := range targets {
+		err := s.srv.Push(ctx, h.notify, &Event{
+			Subscription: s.id,
+			Topic:        topic,
+			Data:         bits,
+		})
+		if err != nil {
+			h.dropServer(s.srv)
+		} else {
+			nsent++
+		}
+	}
+	return nsent, nil
+}
+
+// Assign implements part of the jrpc2.Assigner interface.
+func (h *Hub) Assign(method string) jrpc2.Handler {
+	switch method {
+	case "Subscribe":
+		return jrpc2.NewHandler(h.subscribe)
+	case "Unsubscribe":
+		return jrpc2.NewHandler(h.unsubscribe)
+	}
+	return nil
+}
+
+// Names implements part of the jrpc2.Assigner interface.
+func (*Hub) Names() []string { return []string{"Subscribe", "Unsubscribe"} }
+
+// subscribe implements the Subscribe method. It returns the ID of a new
+// subscription to the requested topic for the calling connection.
+func (h *Hub) subscribe(ctx context.Context, req *SubscribeRequest) (string, error) {
+	srv := jrpc2.ActiveServer(ctx)
+	if srv == nil {
+		return "", jrpc2.Errorf(code.InternalError, "no server for subscription")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs, ok := h.topics[req.Topic]
+	if !ok {
+		return "", jrpc2.Errorf(code.InvalidParams, "unknown topic %q", req.Topic)
+	}
+	h.nextID++
+	s := &sub{
+		id:    strconv.FormatInt(h.nextID, 10),
+		topic: req.Topic,
+		srv:   srv,
+	}
+	subs[s.id] = s
+	h.subs[s.id] = s
+
+	// The first time we see a server, arrange to clean up its subscriptions
+	// when it exits.
+	conn, ok := h.conns[srv]
+	if !ok {
+		conn = make(map[string]*sub)
+		h.conns[srv] = conn
+		go func() {
+			<-srv.Done() // N.B. not Wait, which belongs to the owner of srv
+			h.dropServer(srv)
+		}()
+	}
+	conn[s.id] = s
+	return s.id, nil
+}
+
+// unsubscribe implements the Unsubscribe method. It reports whether the
+// specified subscription existed. A connection may only cancel its own
+// subscriptions.
+func (h *Hub) unsubscribe(ctx context.Context, req *UnsubscribeRequest) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.subs[req.ID]
+	if !ok || s.srv != jrpc2.ActiveServer(ctx) {
+		return false, nil
+	}
+	h.dropLocked(s)
+	return true, nil
+}
+
+// dropServer discards all the subscriptions belonging to srv.
+func (h *Hub) dropServer(srv *jrpc2.Server) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.conns[srv] {
+		h.dropLocked(s)
+	}
+	delete(h.conns, srv)
+}
+
+// dropLocked discards the subscription s. The caller must hold h.mu.
+func (h *Hub) dropLocked(s *sub) {
+	delete(h.topics[s.topic], s.id)
+	delete(h.subs, s.id)
+	delete(h.conns[s.srv], s.id)
+}
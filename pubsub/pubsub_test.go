@@ -0,0 +1,187 @@
+package pubsub
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/channel"
+	"github.com/herenow/jrpc2/code"
+)
+
+// newConn starts a server for hub and returns a client connected to it, along
+// with the subscriber installed on the client.
+func newConn(t *testing.T, hub *Hub) (*jrpc2.Server, *jrpc2.Client, *Subscriber) {
+	t.Helper()
+	cpipe, spipe := channel.Pipe(channel.Line)
+	srv := jrpc2.NewServer(jrpc2.ServiceMapper{"pubsub": hub}, &jrpc2.ServerOptions{
+		AllowPush: true,
+	}).Start(spipe)
+	sub := NewSubscriber(nil)
+	cli := jrpc2.NewClient(cpipe, &jrpc2.ClientOptions{OnNotify: sub.Notify})
+	return srv, cli, sub
+}
+
+func recv(t *testing.T, s *Subscription) *Event {
+	t.Helper()
+	select {
+	case evt := <-s.C:
+		return evt
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for an event on subscription %q", s.ID)
+	}
+	return nil
+}
+
+func TestHub(t *testing.T) {
+	ctx := context.Background()
+	hub := NewHub(nil)
+	hub.AddTopic("news")
+	hub.AddTopic("weather")
+
+	srv1, cli1, sub1 := newConn(t, hub)
+	defer cli1.Close()
+	srv2, cli2, sub2 := newConn(t, hub)
+	defer cli2.Close()
+
+	// Subscribing to an unknown topic fails.
+	if s, err := sub1.Subscribe(ctx, cli1, "gossip"); err == nil {
+		t.Errorf("Subscribe(gossip): got %+v, want error", s)
+	} else if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.InvalidParams {
+		t.Errorf("Subscribe(gossip): got error %v, want %v", err, code.InvalidParams)
+	}
+
+	news1, err := sub1.Subscribe(ctx, cli1, "news")
+	if err != nil {
+		t.Fatalf("Subscribe(news): unexpected error: %v", err)
+	}
+	news2, err := sub2.Subscribe(ctx, cli2, "news")
+	if err != nil {
+		t.Fatalf("Subscribe(news): unexpected error: %v", err)
+	}
+	weather2, err := sub2.Subscribe(ctx, cli2, "weather")
+	if err != nil {
+		t.Fatalf("Subscribe(weather): unexpected error: %v", err)
+	}
+
+	// Events reach only the subscribers to their topic, in order.
+	for _, headline := range []string{"extra", "extra!", "read all about it"} {
+		if n, err := hub.Publish(ctx, "news", headline); err != nil {
+			t.Fatalf("Publish(news): unexpected error: %v", err)
+		} else if n != 2 {
+			t.Errorf("Publish(news): sent to %d subscribers, want 2", n)
+		}
+	}
+	if _, err := hub.Publish(ctx, "weather", "rain"); err != nil {
+		t.Fatalf("Publish(weather): unexpected error: %v", err)
+	}
+	for _, s := range []*Subscription{news1, news2} {
+		for _, want := range []string{"extra", "extra!", "read all about it"} {
+			evt := recv(t, s)
+			var got string
+			if err := evt.UnmarshalData(&got); err != nil {
+				t.Errorf("UnmarshalData: unexpected error: %v", err)
+			} else if got != want || evt.Topic != "news" || evt.Subscription != s.ID {
+				t.Errorf("Event: got %q on %q/%q, want %q on news/%q",
+					got, evt.Topic, evt.Subscription, want, s.ID)
+			}
+		}
+	}
+	if evt := recv(t, weather2); string(evt.Data) != `"rain"` {
+		t.Errorf("Weather: got %s, want rain", string(evt.Data))
+	}
+
+	// A connection may not cancel another connection's subscription.
+	var ok bool
+	if err := cli1.CallResult(ctx, "pubsub.Unsubscribe", &UnsubscribeRequest{ID: news2.ID}, &ok); err != nil {
+		t.Errorf("Unsubscribe: unexpected error: %v", err)
+	} else if ok {
+		t.Errorf("Unsubscribe(%q) from another connection succeeded", news2.ID)
+	}
+
+	// After closing, a subscription no longer receives events.
+	if err := news1.Close(ctx); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if evt, ok := <-news1.C; ok {
+		t.Errorf("Receive after close: got %+v, want closed channel", evt)
+	}
+	if n, err := hub.Publish(ctx, "news", "late edition"); err != nil {
+		t.Errorf("Publish(news): unexpected error: %v", err)
+	} else if n != 1 {
+		t.Errorf("Publish(news): sent to %d subscribers, want 1", n)
+	}
+
+	// When a server exits, its subscriptions are discarded.
+	srv2.Stop()
+	srv2.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, err := hub.Publish(ctx, "weather", "sun")
+		if err != nil {
+			t.Fatalf("Publish(weather): unexpected error: %v", err)
+		} else if n == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Publish(weather): sent to %d subscribers after disconnect, want 0", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv1.Stop()
+	srv1.Wait()
+}
+
+func TestNext(t *testing.T) {
+	ctx := context.Background()
+	hub := NewHub(nil)
+	hub.AddTopic("scores")
+
+	srv, cli, sub := newConn(t, hub)
+	defer func() { srv.Stop(); srv.Wait() }()
+	defer cli.Close()
+
+	s, err := sub.Subscribe(ctx, cli, "scores")
+	if err != nil {
+		t.Fatalf("Subscribe(scores): unexpected error: %v", err)
+	}
+
+	// Next decodes the data of each event into a Go value.
+	type score struct {
+		Team   string `json:"team"`
+		Points int    `json:"points"`
+	}
+	want := []score{{"red", 3}, {"blue", 5}}
+	for _, v := range want {
+		if _, err := hub.Publish(ctx, "scores", v); err != nil {
+			t.Fatalf("Publish(scores): unexpected error: %v", err)
+		}
+	}
+	tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	for _, w := range want {
+		var got score
+		if err := s.Next(tctx, &got); err != nil {
+			t.Fatalf("Next: unexpected error: %v", err)
+		} else if got != w {
+			t.Errorf("Next: got %+v, want %+v", got, w)
+		}
+	}
+
+	// Next gives up when its context ends.
+	sctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	var got score
+	if err := s.Next(sctx, &got); err != context.DeadlineExceeded {
+		t.Errorf("Next: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// After the subscription is closed, Next reports io.EOF.
+	if err := s.Close(ctx); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if err := s.Next(ctx, &got); err != io.EOF {
+		t.Errorf("Next after close: got %v, want %v", err, io.EOF)
+	}
+}
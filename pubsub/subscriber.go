@@ -0,0 +1,213 @@
+package pubsub
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/herenow/jrpc2"
+)
+
+// A Subscriber receives event notifications from a Hub on behalf of a
+// *jrpc2.Client, and delivers them to the matching subscriptions. To use a
+// Subscriber, install its Notify method as the OnNotify callback of the
+// client:
+//
+//    sub := pubsub.NewSubscriber(nil)
+//    cli := jrpc2.NewClient(ch, &jrpc2.ClientOptions{OnNotify: sub.Notify})
+//    s, err := sub.Subscribe(ctx, cli, "news")
+//    ...
+//    for evt := range s.C {
+//       log.Printf("News: %s", string(evt.Data))
+//    }
+//
+// To receive the data of each event as a Go value of the type published to
+// the topic, use the Next method of the subscription instead of C:
+//
+//    var story Story
+//    for s.Next(ctx, &story) == nil {
+//       log.Printf("News: %s", story.Headline)
+//    }
+//
+// A *Subscriber is safe for concurrent use by multiple goroutines.
+type Subscriber struct {
+	opts *Options
+
+	mu       sync.Mutex
+	subs     map[string]*Subscription // active subscriptions, by ID
+	early    map[string][]*Event      // events for IDs not yet registered
+	inflight int                      // number of Subscribe calls in progress
+}
+
+// NewSubscriber constructs a new Subscriber with no subscriptions.
+func NewSubscriber(opts *Options) *Subscriber {
+	return &Subscriber{
+		opts:  opts,
+		subs:  make(map[string]*Subscription),
+		early: make(map[string][]*Event),
+	}
+}
+
+// Notify handles a server notification. If req is an event notification for
+// an active subscription, the event is queued for delivery on the channel for
+// that subscription; otherwise req is ignored. Notify does not block.
+//
+// To handle other notifications as well, call Notify from the OnNotify
+// callback of the client when req.Method() is the event method.
+func (s *Subscriber) Notify(req *jrpc2.Request) {
+	if req.Method() != s.opts.notify() {
+		return
+	}
+	evt := new(Event)
+	if err := req.UnmarshalParams(evt); err != nil {
+		return // discard malformed events
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub, ok := s.subs[evt.Subscription]; ok {
+		sub.push(evt)
+	} else if s.inflight > 0 {
+		// The event may belong to a subscription whose Subscribe call has not
+		// yet returned to the caller. Hold it until that call completes.
+		s.early[evt.Subscription] = append(s.early[evt.Subscription], evt)
+	}
+}
+
+// Subscribe calls the Subscribe method of the Hub via cli, and returns a new
+// subscription to the given topic. The caller must close the subscription
+// when it is no longer needed.
+func (s *Subscriber) Subscribe(ctx context.Context, cli *jrpc2.Client, topic string) (*Subscription, error) {
+	s.mu.Lock()
+	s.inflight++
+	s.mu.Unlock()
+
+	var id string
+	err := cli.CallResult(ctx, s.opts.method("Subscribe"), &SubscribeRequest{Topic: topic}, &id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight--
+	var sub *Subscription
+	if err == nil {
+		sub = newSubscription(s, cli, id, topic)
+		for _, evt := range s.early[id] {
+			sub.push(evt)
+		}
+		s.subs[id] = sub
+		delete(s.early, id)
+	}
+	if s.inflight == 0 {
+		// No more subscriptions are pending, so any remaining events do not
+		// belong to anyone.
+		s.early = make(map[string][]*Event)
+	}
+	return sub, err
+}
+
+// A Subscription is a single subscription to a topic. Events published to the
+// topic are delivered in order on the channel C. The channel is unbuffered,
+// but events are queued without bound until the receiver is ready for them.
+type Subscription struct {
+	ID    string        // the subscription ID assigned by the Hub
+	Topic string        // the topic subscribed to
+	C     <-chan *Event // delivers events to the receiver
+
+	ch    chan *Event
+	owner *Subscriber
+	cli   *jrpc2.Client
+	ready chan struct{} // signals that the queue is non-empty
+	done  chan struct{} // closed when the subscription is closed
+	once  sync.Once
+
+	mu    sync.Mutex
+	queue []*Event
+}
+
+func newSubscription(owner *Subscriber, cli *jrpc2.Client, id, topic string) *Subscription {
+	ch := make(chan *Event)
+	sub := &Subscription{
+		ID:    id,
+		Topic: topic,
+		C:     ch,
+		ch:    ch,
+		owner: owner,
+		cli:   cli,
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	go sub.run()
+	return sub
+}
+
+// push adds evt to the queue for delivery.
+func (s *Subscription) push(evt *Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, evt)
+	s.mu.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued events to the receiver until s is closed.
+func (s *Subscription) run() {
+	defer close(s.ch)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.ready:
+		}
+		for {
+			s.mu.Lock()
+			if len(s.queue) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			next := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+
+			select {
+			case <-s.done:
+				return
+			case s.ch <- next:
+			}
+		}
+	}
+}
+
+// Next waits for the next event on s and decodes its data into v, which should
+// be a pointer to a value of the type published to the topic. It returns
+// io.EOF if s is closed, or the error from ctx if it ends first. Next and C
+// deliver from the same sequence of events, so each event is received by only
+// one of them.
+func (s *Subscription) Next(ctx context.Context, v interface{}) error {
+	select {
+	case evt, ok := <-s.C:
+		if !ok {
+			return io.EOF
+		}
+		return evt.UnmarshalData(v)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close cancels the subscription by calling the Unsubscribe method of the
+// Hub, and closes the channel C. Any events not yet received are discarded.
+// It is safe to call Close more than once; subsequent calls do nothing and
+// return nil.
+func (s *Subscription) Close(ctx context.Context) error {
+	var err error
+	s.once.Do(func() {
+		s.owner.mu.Lock()
+		delete(s.owner.subs, s.ID)
+		s.owner.mu.Unlock()
+		close(s.done)
+		_, err = s.cli.Call(ctx, s.owner.opts.method("Unsubscribe"), &UnsubscribeRequest{ID: s.ID})
+	})
+	return err
+}
@@ -0,0 +1,176 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/herenow/jrpc2/code"
+)
+
+// A Fake is a channel.Channel that plays the role of a server, answering the
+// requests sent to it with the responses from a recording. A client may use
+// a Fake in place of a channel connected to a real server.
+//
+// Each request is matched to a recorded request having the same method and
+// equivalent parameters, and the recorded response to that request is
+// returned with its ID replaced by the ID of the new request. If the same
+// request was recorded more than once, the recorded responses are used in
+// order, and the last one is repeated once they are exhausted. A call that
+// matches no recorded request receives an error response with code
+// code.MethodNotFound. Server notifications in the recording are not
+// replayed.
+type Fake struct {
+	responses map[string][]json.RawMessage // recorded responses by request key
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte // messages awaiting Recv
+	closed bool
+}
+
+// NewFake constructs a Fake that responds with the responses in entries.
+func NewFake(entries []*Entry) *Fake {
+	reqDir := requestDir(entries)
+
+	// Index the recorded responses by ID, then match them to the requests.
+	byID := make(map[string]json.RawMessage)
+	for _, e := range entries {
+		if e.Dir == reqDir {
+			continue
+		}
+		msgs, _, err := parseMessages(e.Data())
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			if id := canonical(msg.ID); id != "" && id != "null" {
+				bits, _ := json.Marshal(msg)
+				byID[id] = bits
+			}
+		}
+	}
+	f := &Fake{responses: make(map[string][]json.RawMessage)}
+	f.cond = sync.NewCond(&f.mu)
+	for _, e := range entries {
+		if e.Dir != reqDir {
+			continue
+		}
+		msgs, _, err := parseMessages(e.Data())
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			if rsp, ok := byID[canonical(msg.ID)]; ok {
+				key := requestKey(msg)
+				f.responses[key] = append(f.responses[key], rsp)
+			}
+		}
+	}
+	return f
+}
+
+// requestKey returns the key used to match requests with the same method and
+// equivalent parameters.
+func requestKey(msg *message) string { return msg.M + "\x00" + canonical(msg.P) }
+
+// Send implements part of the channel.Channel interface. It computes the
+// response to the request in msg, and queues it to be returned by Recv.
+func (f *Fake) Send(msg []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return io.ErrClosedPipe
+	}
+	reqs, isBatch, err := parseMessages(msg)
+	if err != nil {
+		f.push(errorResponse(nil, code.ParseError, "invalid JSON request message"))
+		return nil
+	}
+	var rsps []json.RawMessage
+	for _, req := range reqs {
+		if len(req.ID) == 0 {
+			continue // notifications do not get responses
+		}
+		rsps = append(rsps, f.respond(req))
+	}
+	if len(rsps) == 0 {
+		return nil
+	} else if !isBatch {
+		f.push(rsps[0])
+		return nil
+	}
+	bits, err := json.Marshal(rsps)
+	if err != nil {
+		return err
+	}
+	f.push(bits)
+	return nil
+}
+
+// respond returns the response to req. The caller must hold f.mu.
+func (f *Fake) respond(req *message) json.RawMessage {
+	key := requestKey(req)
+	rsps := f.responses[key]
+	if len(rsps) == 0 {
+		return errorResponse(req.ID, code.MethodNotFound,
+			fmt.Sprintf("no recorded response for %q", req.M))
+	}
+	rsp := rsps[0]
+	if len(rsps) > 1 {
+		f.responses[key] = rsps[1:]
+	}
+
+	// Replace the recorded ID with the ID of the request.
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rsp, &fields); err != nil {
+		return errorResponse(req.ID, code.InternalError, "invalid recorded response")
+	}
+	fields["id"] = req.ID
+	bits, _ := json.Marshal(fields)
+	return bits
+}
+
+// push queues msg to be returned by Recv. The caller must hold f.mu.
+func (f *Fake) push(msg []byte) {
+	f.queue = append(f.queue, msg)
+	f.cond.Signal()
+}
+
+// Recv implements part of the channel.Channel interface. It blocks until a
+// response is available, or f is closed.
+func (f *Fake) Recv() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.queue) == 0 && !f.closed {
+		f.cond.Wait()
+	}
+	if len(f.queue) == 0 {
+		return nil, io.EOF
+	}
+	next := f.queue[0]
+	f.queue = f.queue[1:]
+	return next, nil
+}
+
+// Close implements part of the channel.Channel interface.
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.cond.Broadcast()
+	return nil
+}
+
+func errorResponse(id json.RawMessage, c code.Code, msg string) json.RawMessage {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	edata, _ := json.Marshal(struct {
+		Code    int32  `json:"code"`
+		Message string `json:"message"`
+	}{int32(c), msg})
+	bits, _ := json.Marshal(&message{V: "2.0", ID: id, E: edata})
+	return bits
+}
@@ -0,0 +1,369 @@
+// Package replay supports recording and replaying JSON-RPC traffic.
+//
+// A recording is a sequence of entries, one for each message sent or received
+// by one endpoint of a channel, stored in JSON Lines format (one JSON object
+// per line):
+//
+//    {"time":"2018-06-01T10:00:00Z","dir":"send","msg":{"jsonrpc":"2.0","id":1,"method":"Add","params":[1,2]}}
+//    {"time":"2018-06-01T10:00:00.01Z","dir":"recv","msg":{"jsonrpc":"2.0","id":1,"result":3}}
+//
+// To make a recording, wrap the channel used by a client or server with
+// Record. To use a recording, parse it with Load, then either pass it to Check
+// to verify that a server produces the same responses, or to NewFake to serve
+// the recorded responses to a client.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/herenow/jrpc2/channel"
+	"github.com/herenow/jrpc2/internal/canon"
+)
+
+// Directions of recorded messages, relative to the recorded endpoint.
+const (
+	Send = "send" // a message sent by the endpoint
+	Recv = "recv" // a message received by the endpoint
+)
+
+// An Entry is a single recorded message.
+type Entry struct {
+	Time time.Time       `json:"time"`
+	Dir  string          `json:"dir"`           // Send or Recv
+	Msg  json.RawMessage `json:"msg,omitempty"` // the message, if it is valid JSON
+	Raw  string          `json:"raw,omitempty"` // the message, if it is not valid JSON
+}
+
+// Data returns the content of the message recorded by e.
+func (e *Entry) Data() []byte {
+	if e.Msg != nil {
+		return e.Msg
+	}
+	return []byte(e.Raw)
+}
+
+// Record returns a channel that delegates to ch, and writes an entry to w for
+// each message successfully sent or received. The entries are written
+// atomically, so the channel may be used concurrently by one sender and one
+// receiver as usual.
+func Record(ch channel.Channel, w io.Writer) *Recorder {
+	return &Recorder{ch: ch, w: w}
+}
+
+// A Recorder is a channel.Channel that records the messages it transmits.
+type Recorder struct {
+	ch channel.Channel
+
+	mu  sync.Mutex
+	w   io.Writer
+	err error // the first error writing the recording
+}
+
+// Send implements part of the channel.Channel interface.
+func (r *Recorder) Send(msg []byte) error {
+	if err := r.ch.Send(msg); err != nil {
+		return err
+	}
+	r.record(Send, msg)
+	return nil
+}
+
+// Recv implements part of the channel.Channel interface.
+func (r *Recorder) Recv() ([]byte, error) {
+	msg, err := r.ch.Recv()
+	if err == nil || len(msg) != 0 {
+		r.record(Recv, msg)
+	}
+	return msg, err
+}
+
+// Close implements part of the channel.Channel interface. It closes the
+// underlying channel, but not the writer for the recording.
+func (r *Recorder) Close() error { return r.ch.Close() }
+
+// Err reports the first error that occurred while writing the recording, or
+// nil if there have been none.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(dir string, msg []byte) {
+	e := &Entry{Time: time.Now().UTC(), Dir: dir}
+	if json.Valid(msg) {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, msg); err == nil {
+			e.Msg = buf.Bytes()
+		}
+	}
+	if e.Msg == nil {
+		e.Raw = string(msg)
+	}
+	bits, err := json.Marshal(e)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		_, err = r.w.Write(append(bits, '\n'))
+	}
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// Load reads a recording from r. Blank lines are ignored.
+func Load(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<26)
+	for ln := 1; s.Scan(); ln++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		e := new(Entry)
+		if err := json.Unmarshal(line, e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", ln, err)
+		} else if e.Dir != Send && e.Dir != Recv {
+			return nil, fmt.Errorf("line %d: invalid direction %q", ln, e.Dir)
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// message is the union of the fields of a request and a response.
+type message struct {
+	V  string          `json:"jsonrpc,omitempty"`
+	ID json.RawMessage `json:"id,omitempty"`
+	M  string          `json:"method,omitempty"`
+	P  json.RawMessage `json:"params,omitempty"`
+	R  json.RawMessage `json:"result,omitempty"`
+	E  json.RawMessage `json:"error,omitempty"`
+}
+
+// parseMessages decodes a message or a batch of messages from data, and
+// reports whether data was a batch.
+func parseMessages(data []byte) ([]*message, bool, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) != 0 && data[0] == '[' {
+		var msgs []*message
+		err := json.Unmarshal(data, &msgs)
+		return msgs, true, err
+	}
+	msg := new(message)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, false, err
+	}
+	return []*message{msg}, false, nil
+}
+
+// canonical returns a canonical encoding of the JSON value in data, in which
+// object keys are sorted and insignificant whitespace is removed.  If data is
+// not valid JSON, it is returned unmodified.
+func canonical(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	bits, err := canon.JSON(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(bits)
+}
+
+// requestDir returns the direction of requests in entries, which is the
+// direction of the first message, since a conversation always begins with a
+// request from the client.
+func requestDir(entries []*Entry) string {
+	if len(entries) == 0 {
+		return Send
+	}
+	return entries[0].Dir
+}
+
+// A Mismatch describes a difference between a recorded response and the
+// response received during a Check.
+type Mismatch struct {
+	ID   string // the request ID, or "" for a response without an ID
+	Want string // the recorded response, or "" if none
+	Got  string // the response received, or "" if none
+}
+
+// A CheckError is the concrete type of the error reported by Check when the
+// responses from the server do not match the recording.
+type CheckError struct {
+	Mismatches []Mismatch
+}
+
+func (c *CheckError) Error() string {
+	msgs := make([]string, len(c.Mismatches))
+	for i, m := range c.Mismatches {
+		msgs[i] = fmt.Sprintf("id %s: got %s, want %s", m.ID, or(m.Got, "nothing"), or(m.Want, "nothing"))
+	}
+	return fmt.Sprintf("%d mismatched responses: %s", len(msgs), strings.Join(msgs, "; "))
+}
+
+func or(s, alt string) string {
+	if s == "" {
+		return alt
+	}
+	return s
+}
+
+// Check replays the requests in entries to a server via ch, and verifies that
+// the server's responses match the responses in the recording. Responses are
+// matched by request ID, and compared after canonicalization. Responses
+// without an ID, such as server notifications, are compared as a set.
+//
+// Requests are sent in the order they were recorded. Before sending each
+// request, Check waits until it has received as many messages from the
+// server as were recorded before that request. Check gives up and reports an
+// error if ctx ends before all the expected responses are received. If the
+// responses do not match, the error has concrete type *CheckError.
+//
+// Check does not close ch.
+func Check(ctx context.Context, ch channel.Channel, entries []*Entry) error {
+	reqDir := requestDir(entries)
+
+	// Receive responses in the background, so that we can give up when ctx
+	// ends even if the server is blocked.
+	type result struct {
+		msg []byte
+		err error
+	}
+	recv := make(chan result)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			msg, err := ch.Recv()
+			select {
+			case recv <- result{msg, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var got [][]byte
+	want := 0
+	waitFor := func(n int) error {
+		for len(got) < n {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("received %d of %d responses: %v", len(got), n, ctx.Err())
+			case r := <-recv:
+				if r.err != nil {
+					return fmt.Errorf("received %d of %d responses: %v", len(got), n, r.err)
+				}
+				got = append(got, r.msg)
+			}
+		}
+		return nil
+	}
+	var wantMsgs [][]byte
+	for _, e := range entries {
+		if e.Dir != reqDir {
+			want++
+			wantMsgs = append(wantMsgs, e.Data())
+			continue
+		}
+		if err := waitFor(want); err != nil {
+			return err
+		}
+		if err := ch.Send(e.Data()); err != nil {
+			return err
+		}
+	}
+	if err := waitFor(want); err != nil {
+		return err
+	}
+	return compare(wantMsgs, got)
+}
+
+// compare matches the responses in want and got by ID, and reports an error
+// describing any that differ.
+func compare(want, got [][]byte) error {
+	wantByID, wantNoID := index(want)
+	gotByID, gotNoID := index(got)
+
+	var ms []Mismatch
+	var ids []string
+	for id := range wantByID {
+		ids = append(ids, id)
+	}
+	for id := range gotByID {
+		if _, ok := wantByID[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if w, g := wantByID[id], gotByID[id]; w != g {
+			ms = append(ms, Mismatch{ID: id, Want: w, Got: g})
+		}
+	}
+
+	// Responses without IDs are compared as multisets.
+	count := make(map[string]int)
+	for _, w := range wantNoID {
+		count[w]++
+	}
+	for _, g := range gotNoID {
+		count[g]--
+	}
+	var keys []string
+	for key := range count {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for n := count[key]; n > 0; n-- {
+			ms = append(ms, Mismatch{Want: key})
+		}
+		for n := count[key]; n < 0; n++ {
+			ms = append(ms, Mismatch{Got: key})
+		}
+	}
+	if len(ms) != 0 {
+		return &CheckError{Mismatches: ms}
+	}
+	return nil
+}
+
+// index splits the responses in msgs into those with IDs, indexed by their
+// canonical ID, and those without. Each response is canonicalized.
+func index(msgs [][]byte) (map[string]string, []string) {
+	byID := make(map[string]string)
+	var noID []string
+	for _, data := range msgs {
+		elts, _, err := parseMessages(data)
+		if err != nil {
+			noID = append(noID, canonical(data))
+			continue
+		}
+		for _, elt := range elts {
+			bits, _ := json.Marshal(elt)
+			id := canonical(elt.ID)
+			if id == "" || id == "null" {
+				noID = append(noID, canonical(bits))
+			} else {
+				byID[id] = canonical(bits)
+			}
+		}
+	}
+	return byID, noID
+}
@@ -0,0 +1,142 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/channel"
+	"github.com/herenow/jrpc2/code"
+)
+
+func newServer(add int) (*jrpc2.Server, channel.Channel) {
+	cpipe, spipe := channel.Pipe(channel.Line)
+	srv := jrpc2.NewServer(jrpc2.MapAssigner{
+		"Add": jrpc2.NewHandler(func(ctx context.Context, vs []int) (int, error) {
+			sum := add
+			for _, v := range vs {
+				sum += v
+			}
+			return sum, nil
+		}),
+		"Ping": jrpc2.NewHandler(func(ctx context.Context) (bool, error) { return true, nil }),
+	}, nil).Start(spipe)
+	return srv, cpipe
+}
+
+// makeRecording records a client session against a server, and returns the
+// recording.
+func makeRecording(t *testing.T) []byte {
+	t.Helper()
+	srv, cpipe := newServer(0)
+	defer srv.Wait()
+
+	var buf bytes.Buffer
+	rec := Record(cpipe, &buf)
+	cli := jrpc2.NewClient(rec, nil)
+	ctx := context.Background()
+	if _, err := cli.Call(ctx, "Add", []int{1, 2, 3}); err != nil {
+		t.Fatalf("Call Add: unexpected error: %v", err)
+	}
+	if err := cli.Notify(ctx, "Ping", nil); err != nil {
+		t.Fatalf("Notify Ping: unexpected error: %v", err)
+	}
+	if _, err := cli.Batch(ctx, []jrpc2.Spec{
+		{Method: "Add", Params: []int{5}},
+		{Method: "Add", Params: []int{6, 7}},
+		{Method: "Nonesuch"},
+	}); err != nil {
+		t.Fatalf("Batch: unexpected error: %v", err)
+	}
+	cli.Close()
+	if err := rec.Err(); err != nil {
+		t.Fatalf("Recording failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestRecordCheck(t *testing.T) {
+	data := makeRecording(t)
+	t.Logf("Recording:\n%s", string(data))
+	entries, err := Load(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Load: unexpected error: %v", err)
+	}
+	var dirs []string
+	for _, e := range entries {
+		dirs = append(dirs, e.Dir)
+	}
+	if got, want := strings.Join(dirs, " "), "send recv send send recv"; got != want {
+		t.Errorf("Recorded directions: got %q, want %q", got, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A server with the same behaviour matches the recording.
+	srv, cpipe := newServer(0)
+	if err := Check(ctx, cpipe, entries); err != nil {
+		t.Errorf("Check: unexpected error: %v", err)
+	}
+	cpipe.Close()
+	srv.Wait()
+
+	// A server with different behaviour does not.
+	srv, cpipe = newServer(1)
+	err = Check(ctx, cpipe, entries)
+	if cerr, ok := err.(*CheckError); !ok {
+		t.Errorf("Check: got error %v, want *CheckError", err)
+	} else if n := len(cerr.Mismatches); n != 3 {
+		t.Errorf("Check: got %d mismatches, want 3: %v", n, err)
+	}
+	cpipe.Close()
+	srv.Wait()
+}
+
+func TestFake(t *testing.T) {
+	entries, err := Load(bytes.NewReader(makeRecording(t)))
+	if err != nil {
+		t.Fatalf("Load: unexpected error: %v", err)
+	}
+	cli := jrpc2.NewClient(NewFake(entries), nil)
+	defer cli.Close()
+
+	// Calls matching the recording get the recorded results, regardless of
+	// how the parameters are formatted or batched.
+	ctx := context.Background()
+	tests := []struct {
+		params string
+		want   int
+	}{
+		{`[6, 7]`, 13},
+		{`[1,2,3]`, 6},
+		{`[5]`, 5},
+	}
+	for _, test := range tests {
+		var got int
+		if err := cli.CallResult(ctx, "Add", jsonParams(test.params), &got); err != nil {
+			t.Errorf("Call Add %s: unexpected error: %v", test.params, err)
+		} else if got != test.want {
+			t.Errorf("Call Add %s: got %d, want %d", test.params, got, test.want)
+		}
+	}
+
+	// The recorded error is reproduced.
+	if _, err := cli.Call(ctx, "Nonesuch", nil); err == nil {
+		t.Error("Call Nonesuch: got nil error")
+	} else if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.MethodNotFound {
+		t.Errorf("Call Nonesuch: got error %v, want %v", err, code.MethodNotFound)
+	}
+
+	// Calls not in the recording fail.
+	if _, err := cli.Call(ctx, "Add", []int{100}); err == nil {
+		t.Error("Call Add [100]: got nil error")
+	}
+}
+
+type jsonParams string
+
+func (j jsonParams) MarshalJSON() ([]byte, error) { return []byte(j), nil }
@@ -22,22 +22,42 @@ type logger = func(string, ...interface{})
 // responses on a channel.Channel provided by the caller, and dispatches
 // requests to user-defined Handlers.
 type Server struct {
-	wg     sync.WaitGroup      // ready when workers are done at shutdown time
-	mux    Assigner            // associates method names with handlers
-	sem    *semaphore.Weighted // bounds concurrent execution (default 1)
-	allow1 bool                // allow v1 requests with no version marker
-	allowP bool                // allow server notifications to the client
-	allowB bool                // enable built-in rpc.* methods
-	log    logger              // write debug logs here
-	dectx  decoder             // decode context from request
-	expctx bool                // whether to expect request context
+	wg     sync.WaitGroup         // ready when workers are done at shutdown time
+	mux    Assigner               // associates method names with handlers
+	sem    *semaphore.Weighted    // bounds concurrent execution (default 1)
+	allow1 bool                   // allow v1 requests with no version marker
+	allowP bool                   // allow server notifications to the client
+	allowB bool                   // enable built-in rpc.* methods
+	split  bool                   // send batch responses as they complete
+	log    logger                 // write debug logs here
+	newctx func() context.Context // create a base request context
+	newses sessioner              // create a per-connection session value
+	order  Ordering               // how to order request execution
+	serial serializer             // compute serialization keys, or nil
+	dectx  decoder                // decode context from request
+	expctx bool                   // whether to expect request context
+	auth   authenticator          // identify the caller, or nil
+	authz  authorizer             // authorize requests, or nil
 
 	mu      *sync.Mutex     // protects the fields below
 	err     error           // error from a previous operation
 	work    *sync.Cond      // for signaling message availability
 	inq     *list.List      // inbound requests awaiting processing
+	nbusy   int             // number of request batches in progress
 	ch      channel.Channel // the channel to the client
+	stopped chan struct{}   // closed when the server stops
 	metrics *metrics.M      // metrics collected during execution
+	princ   interface{}     // the principal for the connection, if known
+	session interface{}     // the session value for the connection, or nil
+	last    chan struct{}   // closed when the last ordered task completes
+	limit   *bucket         // rate limit for all requests, or nil
+
+	// For each method with a rate limit, this map carries its token bucket.
+	limits map[string]*bucket
+
+	// For each serialization key in use, this map carries a channel that is
+	// closed when the most recent task with that key completes.
+	keys map[string]chan struct{}
 
 	// For each request ID currently in-flight, this map carries a cancel
 	// function attached to the context that was sent to the handler.
@@ -62,12 +82,20 @@ func NewServer(mux Assigner, opts *ServerOptions) *Server {
 		allow1:  opts.allowV1(),
 		allowP:  opts.allowPush(),
 		allowB:  opts.allowBuiltin(),
+		split:   opts.splitBatches(),
 		log:     opts.logger(),
+		newctx:  opts.newContext(),
+		newses:  opts.newSession(),
+		order:   opts.ordering(),
+		serial:  opts.serializeKey(),
 		dectx:   dc,
 		expctx:  exp,
+		auth:    opts.authenticate(),
+		authz:   opts.authorize(),
 		mu:      new(sync.Mutex),
 		metrics: opts.metrics(),
 	}
+	s.limit, s.limits = opts.rateLimits()
 	return s
 }
 
@@ -82,12 +110,17 @@ func (s *Server) Start(c channel.Channel) *Server {
 
 	// Set up the queues and condition variable used by the workers.
 	s.ch = c
+	s.stopped = make(chan struct{})
 	s.work = sync.NewCond(s.mu)
 	s.inq = list.New()
 	s.used = make(map[string]context.CancelFunc)
 
 	// Reset all the I/O structures and start up the workers.
 	s.err = nil
+	s.princ = nil
+	s.session = s.newses(s.newctx())
+	s.last = nil
+	s.keys = make(map[string]chan struct{})
 
 	// s.wg waits for the maintenance goroutines for receiving input and
 	// processing the request queue. In addition, each request in flight adds a
@@ -131,6 +164,10 @@ func (s *Server) serve() {
 		go func() {
 			defer s.wg.Done()
 			next()
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.nbusy--
 		}()
 	}
 }
@@ -152,8 +189,9 @@ func (s *Server) nextRequest() (func() error, error) {
 	}
 	ch := s.ch // capture
 
-	next := s.inq.Remove(s.inq.Front()).(jrequests)
-	s.log("Processing %d requests", len(next))
+	next := s.inq.Remove(s.inq.Front()).(inbound)
+	s.log("Processing %d requests", len(next.reqs))
+	s.nbusy++
 
 	// Construct a dispatcher to run the handlers outside the lock.
 	return s.dispatch(next, ch), nil
@@ -162,37 +200,66 @@ func (s *Server) nextRequest() (func() error, error) {
 // dispatch constructs a function that invokes each of the specified tasks.
 // The caller must hold s.mu when calling dispatch, but the returned function
 // should be executed outside the lock to wait for the handlers to return.
-func (s *Server) dispatch(next jrequests, ch channel.Sender) func() error {
+func (s *Server) dispatch(next inbound, ch channel.Sender) func() error {
 	// Resolve all the task handlers or record errors.
 	start := time.Now()
-	tasks := s.checkAndAssign(next)
+	stopped := s.stopped // capture
+	ts := s.checkAndAssign(next.reqs)
 	var wg sync.WaitGroup
-	for _, t := range tasks {
+	var bogus tasks
+	for i, t := range ts {
 		if t.err != nil {
+			bogus = append(bogus, t)
 			continue // nothing to do here; this was a bogus one
 		}
-		t := t
+		i, t := i, t
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			t.val, t.err = s.invoke(t.ctx, t.m, &Request{
-				id:     t.reqID,
-				method: t.reqM,
-				params: t.params,
-			})
+			if t.await(stopped) {
+				t.val, t.err = s.invoke(t.ctx, t.m, &Request{
+					id:     t.reqID,
+					method: t.reqM,
+					params: t.params,
+				})
+			}
+			s.release(t)
+
+			// In split mode, each response is sent as soon as it is ready.
+			if s.split {
+				if err := s.deliver(ts[i:i+1].responses(), false, ch, time.Since(start)); err != nil {
+					s.log("Error delivering response: %v", err)
+				}
+			}
 		}()
 	}
 
+	// In split mode, the handlers deliver their own responses, so only the
+	// errors for bogus requests remain to be sent, each in its own message.
+	if s.split {
+		return func() error {
+			var err error
+			for _, rsp := range bogus.responses() {
+				if derr := s.deliver(jresponses{rsp}, false, ch, time.Since(start)); err == nil {
+					err = derr
+				}
+			}
+			wg.Wait()
+			return err
+		}
+	}
+
 	// Wait for all the handlers to return, then deliver any responses.
 	return func() error {
 		wg.Wait()
-		return s.deliver(tasks.responses(), ch, time.Since(start))
+		return s.deliver(ts.responses(), next.batch, ch, time.Since(start))
 	}
 }
 
 // deliver cleans up completed responses and arranges their replies (if any) to
-// be sent back to the client.
-func (s *Server) deliver(rsps jresponses, ch channel.Sender, elapsed time.Duration) error {
+// be sent back to the client. If batch is true, the replies are sent as an
+// array even if there is only one.
+func (s *Server) deliver(rsps jresponses, batch bool, ch channel.Sender, elapsed time.Duration) error {
 	if len(rsps) == 0 {
 		return nil
 	}
@@ -203,10 +270,26 @@ func (s *Server) deliver(rsps jresponses, ch channel.Sender, elapsed time.Durati
 
 	// Ensure all the inflight requests get their contexts cancelled.
 	for _, rsp := range rsps {
-		s.cancel(string(rsp.ID))
+		s.cancel(canonicalID(rsp.ID))
 	}
 
-	nw, err := encode(ch, rsps)
+	var msg interface{} = rsps
+	if batch {
+		msg = []*jresponse(rsps)
+	}
+	nw, err := encode(ch, msg)
+	if _, ok := err.(*json.MarshalerError); ok {
+		// A handler returned an invalid json.RawMessage result, which invoke
+		// does not check. Report it as an error rather than dropping the
+		// replies for the whole batch.
+		for _, rsp := range rsps {
+			if rsp.R != nil && !json.Valid(rsp.R) {
+				rsp.R = nil
+				rsp.E = jerrorf(code.InternalError, "internal error: invalid result")
+			}
+		}
+		nw, err = encode(ch, msg)
+	}
 	s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
 	return err
 }
@@ -219,7 +302,10 @@ func (s *Server) checkAndAssign(next jrequests) tasks {
 		s.log("Checking request for %q: %s", req.M, string(req.P))
 		t := &task{reqID: req.ID, reqM: req.M}
 		req.ID = fixID(req.ID)
-		if id := string(req.ID); id != "" && s.used[id] != nil {
+		id := canonicalID(req.ID)
+		if req.err != nil {
+			t.err = req.err
+		} else if id != "" && s.used[id] != nil {
 			t.err = Errorf(code.InvalidRequest, "duplicate request id %q", id)
 		} else if !s.versionOK(req.V) {
 			t.err = Errorf(code.InvalidRequest, "incorrect version marker")
@@ -229,10 +315,17 @@ func (s *Server) checkAndAssign(next jrequests) tasks {
 			t.err = Errorf(code.MethodNotFound, "no such method %q", req.M)
 		} else if s.setContext(t, id, req.P) {
 			t.m = m
+			s.sequence(t)
 		}
 		if t.err != nil {
 			s.log("Task error: %v", t.err)
 			s.metrics.Count("rpc.errors", 1)
+
+			// Spec: An invalid request object is not a notification, and gets
+			// an error response with a null ID if it does not have an ID.
+			if t.reqID == nil && code.FromError(t.err) == code.InvalidRequest {
+				t.reqID = json.RawMessage("null")
+			}
 		}
 		tasks = append(tasks, t)
 	}
@@ -242,7 +335,7 @@ func (s *Server) checkAndAssign(next jrequests) tasks {
 // setContext constructs and attaches a request context to t, and reports
 // whether this succeeded.
 func (s *Server) setContext(t *task, id string, rawParams json.RawMessage) bool {
-	base, params, err := s.dectx(context.Background(), rawParams)
+	base, params, err := s.dectx(s.newctx(), rawParams)
 	if err != nil {
 		t.err = Errorf(code.InternalError, "invalid request context: %v", err)
 	} else if id != "" {
@@ -256,18 +349,87 @@ func (s *Server) setContext(t *task, id string, rawParams json.RawMessage) bool
 	return err == nil
 }
 
+// sequence arranges for t to wait for the completion of any earlier tasks that
+// must precede it, according to the ordering policy of s. The caller must hold
+// s.mu.
+func (s *Server) sequence(t *task) {
+	if s.allowB && strings.HasPrefix(t.reqM, "rpc.") {
+		return // built-in methods are not ordered
+	}
+	done := make(chan struct{})
+	switch s.order {
+	case Sequential:
+		t.after(s.last)
+		s.last = done
+	case OrderedNotifications:
+		t.after(s.last)
+		if t.reqID == nil {
+			s.last = done
+		}
+	}
+	if s.serial != nil {
+		key := s.serial(&Request{id: t.reqID, method: t.reqM, params: t.params})
+		if key != "" {
+			t.after(s.keys[key])
+			s.keys[key] = done
+			t.key = key
+		}
+	}
+	t.done = done
+}
+
+// release marks t as complete, allowing any tasks ordered after it to proceed.
+func (s *Server) release(t *task) {
+	if t.done == nil {
+		return // t is not ordered
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(t.done)
+	if s.last == t.done {
+		s.last = nil
+	}
+	if t.key != "" && s.keys[t.key] == t.done {
+		delete(s.keys, t.key)
+	}
+}
+
 // invoke invokes the handler m for the specified request type, and marshals
 // the return value into JSON if there is one.
 func (s *Server) invoke(base context.Context, h Handler, req *Request) (json.RawMessage, error) {
 	ctx := context.WithValue(base, inboundRequestKey{}, req)
 	ctx = context.WithValue(ctx, serverMetricsKey{}, s.metrics)
+	ctx = context.WithValue(ctx, activeServerKey{}, s)
+	if s.session != nil {
+		ctx = context.WithValue(ctx, serverSessionKey{}, s.session)
+	}
 	if s.allowP {
 		ctx = context.WithValue(ctx, serverPushKey{}, s.Push)
 	}
-	if err := s.sem.Acquire(ctx, 1); err != nil {
+	ctx, err := s.checkAuth(ctx, req)
+	if err == nil {
+		// Charge the rate limits only once the request is authorized, so that
+		// rejected requests do not consume the budget of the client.
+		s.mu.Lock()
+		err = s.checkRate(req.method)
+		s.mu.Unlock()
+	}
+	if err != nil {
+		if req.IsNotification() {
+			s.log("Discarding rejected notification to %q: %v", req.Method(), err)
+			return nil, nil
+		}
 		return nil, err
 	}
-	defer s.sem.Release(1)
+
+	// A cancellation must not wait behind the requests it is meant to cancel,
+	// so rpc.cancel does not count against the concurrency limit.
+	if !s.allowB || req.method != "rpc.cancel" {
+		if err := s.sem.Acquire(ctx, 1); err != nil {
+			return nil, err
+		}
+		defer s.sem.Release(1)
+	}
 
 	v, err := h.Handle(ctx, req)
 	if err != nil {
@@ -277,9 +439,57 @@ func (s *Server) invoke(base context.Context, h Handler, req *Request) (json.Raw
 		}
 		return nil, err // a call reporting an error
 	}
+	if raw, ok := v.(json.RawMessage); ok {
+		if len(raw) == 0 {
+			// An empty result would be omitted from the response, which
+			// must have either a result or an error.
+			return json.RawMessage("null"), nil
+		}
+		return raw, nil // already encoded; the response encoder checks it
+	}
 	return json.Marshal(v)
 }
 
+// checkAuth establishes the principal for req and checks that it is permitted
+// to invoke the requested method. It returns the context to be passed to the
+// handler, including the principal (if any).
+func (s *Server) checkAuth(ctx context.Context, req *Request) (context.Context, error) {
+	if s.auth == nil && s.authz == nil {
+		return ctx, nil
+	} else if s.allowB && (req.method == "rpc.authenticate" || req.method == "rpc.cancel") {
+		return ctx, nil // these built-ins do not require credentials
+	}
+
+	s.mu.Lock()
+	p := s.princ
+	s.mu.Unlock()
+	if p == nil && s.auth != nil {
+		v, err := s.auth(ctx, req)
+		if err != nil {
+			return nil, authError(code.Unauthenticated, err)
+		}
+		p = v
+	}
+	if p != nil {
+		ctx = context.WithValue(ctx, principalKey{}, p)
+	}
+	if s.authz != nil {
+		if err := s.authz(ctx, req); err != nil {
+			return nil, authError(code.PermissionDenied, err)
+		}
+	}
+	return ctx, nil
+}
+
+// authError converts err into an *Error with the given code, unless it is
+// already an *Error.
+func authError(c code.Code, err error) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return Errorf(c, "%s: %v", c.Error(), err)
+}
+
 // ServerInfo returns an atomic snapshot of the current server info for s.
 func (s *Server) ServerInfo() *ServerInfo {
 	s.mu.Lock()
@@ -290,7 +500,8 @@ func (s *Server) ServerInfo() *ServerInfo {
 // Push posts a server-side notification to the client.  This is a non-standard
 // extension of JSON-RPC, and may not be supported by all clients.  Unless s
 // was constructed with the AllowNotify option set true, this method will
-// always report an error without sending anything.
+// always report an error without sending anything. Push also reports an error
+// if the server is not running.
 func (s *Server) Push(ctx context.Context, method string, params interface{}) error {
 	if !s.allowP {
 		return errors.New("server notifications are disabled")
@@ -305,6 +516,9 @@ func (s *Server) Push(ctx context.Context, method string, params interface{}) er
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.ch == nil {
+		return errServerStopped
+	}
 	s.log("Posting server notification %q %s", method, string(bits))
 	nw, err := encode(s.ch, jresponses{{
 		V: Version,
@@ -332,6 +546,14 @@ func (s *Server) serverInfo() *ServerInfo {
 	return info
 }
 
+// Idle reports whether s has no requests awaiting processing or in progress.
+// A server that is not running is idle.
+func (s *Server) Idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ch == nil || (s.inq.Len() == 0 && s.nbusy == 0)
+}
+
 // Stop shuts down the server. It is safe to call this method multiple times or
 // from concurrent goroutines; it will only take effect once.
 func (s *Server) Stop() {
@@ -340,12 +562,36 @@ func (s *Server) Stop() {
 	s.stop(errServerStopped)
 }
 
+// Done returns a channel that is closed when the server stops. Unlike Wait,
+// it does not close the session of the server, so it may be used to watch a
+// server owned by another caller. The server must have been started.
+func (s *Server) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
 // Wait blocks until the connection terminates and returns the resulting error.
+// If the server has a session value that implements io.Closer, it is closed
+// before Wait returns. Only the owner of the server should call Wait; other
+// callers should use Done.
 func (s *Server) Wait() error {
 	s.wg.Wait()
+	s.mu.Lock()
 	s.work = nil
 	s.used = nil
-	return s.err
+	session, err := s.session, s.err
+	s.session = nil
+	s.mu.Unlock()
+
+	// N.B. Close the session outside the lock, as it may call back into the
+	// server, for example to push a final notification.
+	if c, ok := session.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			s.log("Closing session: %v", err)
+		}
+	}
+	return err
 }
 
 // stop shuts down the connection and records err as its final state.  The
@@ -357,21 +603,23 @@ func (s *Server) stop(err error) {
 	}
 	s.log("Server signaled to stop with err=%v", err)
 	s.ch.Close()
+	close(s.stopped)
 
 	// Remove any pending requests from the queue, but retain notifications.
 	// The server will process pending notifications before giving up.
 	for cur := s.inq.Front(); cur != nil; cur = cur.Next() {
+		next := cur.Value.(inbound)
 		var keep jrequests
-		for _, req := range cur.Value.(jrequests) {
+		for _, req := range next.reqs {
 			if req.ID == nil {
 				keep = append(keep, req)
 				s.log("Retaining notification %+v", req)
 			} else {
-				s.cancel(string(req.ID))
+				s.cancel(canonicalID(req.ID))
 			}
 		}
 		if len(keep) != 0 {
-			s.inq.PushBack(keep)
+			s.inq.PushBack(inbound{reqs: keep, batch: next.batch})
 		}
 		s.inq.Remove(cur)
 	}
@@ -400,11 +648,15 @@ func (s *Server) read(ch channel.Receiver) {
 		// TODO(fromberger): Disallow extra fields once 1.10 lands.
 
 		// If the message is not sensible, report an error; otherwise enqueue
-		// it for processing.
+		// it for processing. Since the channel delimits messages, a message
+		// that is not valid JSON does not prevent reading the next one.
 		var in jrequests
 		bits, err := ch.Recv()
 		if err == nil || (err == io.EOF && len(bits) != 0) {
 			err = json.Unmarshal(bits, &in)
+			if _, ok := err.(*json.SyntaxError); ok {
+				err = Errorf(code.ParseError, "invalid JSON request message")
+			}
 		}
 
 		s.metrics.Count("rpc.requests", int64(len(in)))
@@ -412,7 +664,7 @@ func (s *Server) read(ch channel.Receiver) {
 		s.mu.Lock()
 		if err != nil {
 			if e, ok := err.(*Error); ok {
-				s.pushError(e.data, jerrorf(e.code, e.message))
+				s.pushError(nil, jerrorf(e.code, e.message))
 			} else if isRecoverableJSONError(err) {
 				s.pushError(nil, jerrorf(code.ParseError, "invalid JSON request message"))
 			} else {
@@ -429,7 +681,7 @@ func (s *Server) read(ch channel.Receiver) {
 			s.pushError(nil, jerrorf(code.InvalidRequest, "empty request batch"))
 		} else {
 			s.log("Received %d new requests", len(in))
-			s.inq.PushBack(in)
+			s.inq.PushBack(inbound{reqs: in, batch: isArray(bits)})
 			s.work.Broadcast()
 		}
 		s.mu.Unlock()
@@ -462,7 +714,7 @@ func (s *Server) handleRPCCancel(_ context.Context, req *Request) (interface{},
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for _, raw := range ids {
-		id := string(raw)
+		id := canonicalID(raw)
 		if s.cancel(id) {
 			s.log("Cancelled request %s by client order", id)
 		}
@@ -474,6 +726,20 @@ func (s *Server) handleRPCServerInfo(context.Context, *Request) (interface{}, er
 	return s.serverInfo(), nil
 }
 
+// Handle the special rpc.authenticate method, that establishes the principal
+// for the remainder of the connection.
+func (s *Server) handleRPCAuthenticate(ctx context.Context, req *Request) (interface{}, error) {
+	p, err := s.auth(ctx, req)
+	if err != nil {
+		return nil, authError(code.Unauthenticated, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.princ = p
+	s.log("Connection authenticated as %v", p)
+	return true, nil
+}
+
 // assign returns a Handler to handle the specified name, or nil.
 // The caller must hold s.mu.
 func (s *Server) assign(name string) Handler {
@@ -488,6 +754,14 @@ func (s *Server) assign(name string) Handler {
 			// works if issued as a notification.
 			return methodFunc(s.handleRPCCancel)
 
+		case "rpc.authenticate":
+			// Establish the caller's identity for the connection. This is only
+			// available if the server has an authentication hook.
+			if s.auth != nil {
+				return methodFunc(s.handleRPCAuthenticate)
+			}
+			return nil
+
 		default:
 			// Spec: "Method names that begin with rpc. are reserved for system
 			// extensions, and MUST NOT be used for anything else."
@@ -507,6 +781,9 @@ func (s *Server) assign(name string) Handler {
 // hold s.mu when calling this method.
 func (s *Server) pushError(id json.RawMessage, jerr *jerror) {
 	s.log("Error for request %q: %v", string(id), jerr)
+	if id == nil {
+		id = json.RawMessage("null") // spec: the ID could not be determined
+	}
 	nw, err := encode(s.ch, jresponses{{
 		V:  Version,
 		ID: id,
@@ -549,10 +826,52 @@ type task struct {
 
 	val json.RawMessage // the result value (when complete)
 	err error           // the error value (when complete)
+
+	wait []chan struct{} // tasks that must complete before this one starts
+	done chan struct{}   // closed when this task completes, or nil
+	key  string          // the serialization key for this task, if any
+}
+
+// after arranges for t to wait until ch is closed. If ch == nil, after does
+// nothing.
+func (t *task) after(ch chan struct{}) {
+	if ch != nil {
+		t.wait = append(t.wait, ch)
+	}
+}
+
+// await waits for the tasks that must precede t to complete, and reports
+// whether t should run. If the context of t ends first, or if t is a call and
+// stopped is closed first, await records the reason in t.err and returns false.
+// A notification keeps waiting after the server stops, since the server runs
+// the notifications it has received before it exits.
+func (t *task) await(stopped <-chan struct{}) bool {
+	if t.reqID == nil {
+		stopped = nil
+	}
+	for _, ch := range t.wait {
+		select {
+		case <-ch:
+		case <-t.ctx.Done():
+			t.err = t.ctx.Err()
+			return false
+		case <-stopped:
+			t.err = errServerStopped
+			return false
+		}
+	}
+	return true
 }
 
 type tasks []*task
 
+// An inbound is a group of requests received in a single message from the
+// client, awaiting processing.
+type inbound struct {
+	reqs  jrequests
+	batch bool // the requests were sent as an array, even if there is only one
+}
+
 func (ts tasks) responses() jresponses {
 	var rsps jresponses
 	for _, task := range ts {
@@ -2,9 +2,13 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/herenow/jrpc2"
 	"github.com/herenow/jrpc2/channel"
@@ -14,39 +18,238 @@ import (
 // given assigner and options, running in a new goroutine. If accept reports an
 // error, the loop will terminate and the error will be reported once all the
 // servers currently active have returned.
+//
+// Loop is shorthand for New(lst, assigner, opts).Serve(). Use New directly if
+// you need to enumerate or shut down the active connections.
 func Loop(lst net.Listener, assigner jrpc2.Assigner, opts *LoopOptions) error {
-	newChannel := opts.framing()
-	serverOpts := opts.serverOpts()
-	log := func(string, ...interface{}) {}
-	if serverOpts != nil && serverOpts.Logger != nil {
-		log = serverOpts.Logger.Printf
+	return New(lst, assigner, opts).Serve()
+}
+
+// A Server accepts connections from a listener and runs a *jrpc2.Server for
+// each connection, all sharing the same assigner.
+//
+// If LoopOptions.TLSConfig is set, each connection completes a TLS handshake
+// before its server is started. The handler context for each request includes
+// the connection, so that handlers can use Conn to find the remote address,
+// or PeerCertificate to identify a client that presented a certificate.
+type Server struct {
+	lst        net.Listener
+	assigner   jrpc2.Assigner
+	newChannel channel.Framing
+	serverOpts *jrpc2.ServerOptions
+	tlsConfig  *tls.Config
+	handshake  time.Duration // TLS handshake timeout
+	onConnect  func(net.Conn) error
+	onDisc     func(net.Conn, error)
+	slots      chan struct{} // bounds active connections, or nil
+	log        func(string, ...interface{})
+
+	wg      sync.WaitGroup // tracks active connections
+	mu      sync.Mutex     // protects the fields below
+	closing bool
+	pending map[net.Conn]bool // connections whose servers have not started
+	conns   map[net.Conn]*jrpc2.Server
+}
+
+// New constructs a new unstarted server that accepts connections from lst and
+// dispatches requests to assigner. To start serving, call Serve.
+func New(lst net.Listener, assigner jrpc2.Assigner, opts *LoopOptions) *Server {
+	s := &Server{
+		lst:        lst,
+		assigner:   assigner,
+		newChannel: opts.framing(),
+		serverOpts: opts.serverOpts(),
+		tlsConfig:  opts.tlsConfig(),
+		handshake:  opts.handshakeTimeout(),
+		onConnect:  opts.onConnect(),
+		onDisc:     opts.onDisconnect(),
+		log:        func(string, ...interface{}) {},
+		pending:    make(map[net.Conn]bool),
+		conns:      make(map[net.Conn]*jrpc2.Server),
+	}
+	if n := opts.maxConns(); n > 0 {
+		s.slots = make(chan struct{}, n)
 	}
-	var wg sync.WaitGroup
+	if s.serverOpts != nil && s.serverOpts.Logger != nil {
+		s.log = s.serverOpts.Logger.Printf
+	}
+	return s
+}
+
+// Serve accepts connections and serves them until the listener fails or is
+// closed, then waits for the active connections to finish. If the listener
+// was closed, either by the caller or by Shutdown, Serve returns nil;
+// otherwise it returns the error from the listener.
+func (s *Server) Serve() error {
 	for {
-		conn, err := lst.Accept()
+		if s.slots != nil {
+			s.slots <- struct{}{} // wait for a free slot
+		}
+		conn, err := s.lst.Accept()
 		if err != nil {
 			if channel.IsErrClosing(err) {
 				err = nil
 			} else {
-				log("Error accepting new connection: %v", err)
+				s.log("Error accepting new connection: %v", err)
 			}
-			wg.Wait()
+			s.wg.Wait()
 			return err
 		}
-		ch := newChannel(conn, conn)
-		wg.Add(1)
+
+		// Register the connection before starting its goroutine, so that a
+		// concurrent Shutdown either waits for it or sees it and closes it.
+		// Until its server starts, the connection is pending, so that Shutdown
+		// can close it if the TLS handshake or the OnConnect hook does not
+		// finish.
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			if s.slots != nil {
+				<-s.slots
+			}
+			continue // the listener is closed, so Accept will fail
+		}
+		s.pending[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
 		go func() {
-			defer wg.Done()
-			srv := jrpc2.NewServer(assigner, serverOpts).Start(ch)
-			if err := srv.Wait(); err != nil && err != io.EOF {
-				log("Server exit: %v", err)
+			defer s.wg.Done()
+			s.serveConn(conn)
+			if s.slots != nil {
+				<-s.slots
 			}
 		}()
 	}
 }
 
-// LoopOptions control the behaviour of the Loop function.  A nil *LoopOptions
-// provides default values as described.
+// serveConn runs a server for a single connection, which the caller has
+// registered as pending, and blocks until it exits.
+func (s *Server) serveConn(raw net.Conn) {
+	conn, ok := s.prepare(raw)
+
+	s.mu.Lock()
+	delete(s.pending, raw)
+	if !ok || s.closing {
+		s.mu.Unlock()
+		conn.Close() // N.B. outside the lock, as a TLS close may block
+		return
+	}
+	srv := jrpc2.NewServer(s.assigner, connOptions(s.serverOpts, conn)).Start(s.newChannel(conn, conn))
+	s.conns[conn] = srv
+	s.mu.Unlock()
+
+	err := srv.Wait()
+	if err != nil && err != io.EOF {
+		s.log("Server exit: %v", err)
+	}
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	if s.onDisc != nil {
+		s.onDisc(conn, err)
+	}
+}
+
+// prepare completes the TLS handshake for conn, if required, and calls the
+// OnConnect hook. It returns the connection to serve, which is a *tls.Conn if
+// TLS is enabled, and reports whether the connection should be served.
+func (s *Server) prepare(conn net.Conn) (net.Conn, bool) {
+	if s.tlsConfig != nil {
+		tc := tls.Server(conn, s.tlsConfig)
+		conn.SetDeadline(time.Now().Add(s.handshake))
+		err := tc.Handshake()
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			s.log("TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+			return conn, false
+		}
+		conn = tc
+	}
+	if s.onConnect != nil {
+		if err := s.onConnect(conn); err != nil {
+			s.log("Rejected connection from %v: %v", conn.RemoteAddr(), err)
+			return conn, false
+		}
+	}
+	return conn, true
+}
+
+// Conns returns a snapshot of the connections currently being served.
+func (s *Server) Conns() []net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// shutdownPollInterval is how often Shutdown checks for idle connections.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown gracefully stops s: It closes the listener so that no further
+// connections are accepted, then stops the server for each connection once it
+// has no requests pending or in progress. Shutdown blocks until all the
+// connections have closed, or until ctx ends. In the latter case, the
+// remaining servers are stopped immediately and Shutdown returns the error
+// from ctx. Connections whose servers have not yet started, for example
+// because their TLS handshake is incomplete, are closed immediately.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for conn := range s.pending {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.lst.Close()
+
+	tick := time.NewTicker(shutdownPollInterval)
+	defer tick.Stop()
+	for s.stopIdle() != 0 {
+		select {
+		case <-ctx.Done():
+			s.stopAll()
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+
+	// All the servers have exited; wait for the hooks to settle.
+	done := make(chan struct{})
+	go func() { s.wg.Wait(); close(done) }()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+// stopIdle stops each idle server, and reports how many connections remain.
+func (s *Server) stopIdle() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, srv := range s.conns {
+		if srv.Idle() {
+			srv.Stop()
+		}
+	}
+	return len(s.conns)
+}
+
+// stopAll stops all the active servers regardless of their state.
+func (s *Server) stopAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, srv := range s.conns {
+		srv.Stop()
+	}
+}
+
+// LoopOptions control the behaviour of the Loop function and of servers
+// constructed by New.  A nil *LoopOptions provides default values as described.
 type LoopOptions struct {
 	// If non-nil, this function is used to convert a stream connection to an
 	// RPC channel. If this field is nil, channel.RawJSON is used.
@@ -55,6 +258,27 @@ type LoopOptions struct {
 	// If non-nil, these options are used when constructing the server to
 	// handle requests on an inbound connection.
 	ServerOptions *jrpc2.ServerOptions
+
+	// If non-nil, inbound connections are secured with TLS using this
+	// configuration. To require and verify client certificates (mutual TLS),
+	// set its ClientAuth and ClientCAs fields.
+	TLSConfig *tls.Config
+
+	// How long a client is allowed to complete the TLS handshake after it
+	// connects, if TLSConfig is set. If zero, a default of 10 seconds is used.
+	HandshakeTimeout time.Duration
+
+	// If non-nil, this function is called for each new connection before its
+	// server is started. If it reports an error, the connection is closed.
+	OnConnect func(net.Conn) error
+
+	// If non-nil, this function is called after the server for a connection
+	// has exited, with the error reported by its Wait method.
+	OnDisconnect func(net.Conn, error)
+
+	// If positive, at most this many connections are served at once. Further
+	// connections are not accepted until an active connection closes.
+	MaxConns int
 }
 
 func (o *LoopOptions) serverOpts() *jrpc2.ServerOptions {
@@ -70,3 +294,83 @@ func (o *LoopOptions) framing() channel.Framing {
 	}
 	return o.Framing
 }
+
+func (o *LoopOptions) tlsConfig() *tls.Config {
+	if o == nil {
+		return nil
+	}
+	return o.TLSConfig
+}
+
+func (o *LoopOptions) handshakeTimeout() time.Duration {
+	if o == nil || o.HandshakeTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return o.HandshakeTimeout
+}
+
+func (o *LoopOptions) onConnect() func(net.Conn) error {
+	if o == nil {
+		return nil
+	}
+	return o.OnConnect
+}
+
+func (o *LoopOptions) onDisconnect() func(net.Conn, error) {
+	if o == nil {
+		return nil
+	}
+	return o.OnDisconnect
+}
+
+func (o *LoopOptions) maxConns() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxConns
+}
+
+// connOptions returns a copy of opts whose base request context records conn.
+func connOptions(opts *jrpc2.ServerOptions, conn net.Conn) *jrpc2.ServerOptions {
+	cp := new(jrpc2.ServerOptions)
+	if opts != nil {
+		*cp = *opts
+	}
+	newContext := cp.NewContext
+	if newContext == nil {
+		newContext = context.Background
+	}
+	cp.NewContext = func() context.Context {
+		return context.WithValue(newContext(), connKey{}, conn)
+	}
+	return cp
+}
+
+type connKey struct{}
+
+// Conn returns the network connection associated with ctx, or nil if there is
+// none. The context passed to a handler by a server started by Loop or Serve
+// includes this value. If the connection uses TLS, its concrete type is
+// *tls.Conn.
+func Conn(ctx context.Context) net.Conn {
+	if v := ctx.Value(connKey{}); v != nil {
+		return v.(net.Conn)
+	}
+	return nil
+}
+
+// PeerCertificate returns the verified certificate presented by the client on
+// the TLS connection associated with ctx, or nil if there is none. The context
+// passed to a handler by a server started by Loop includes this value when
+// LoopOptions.TLSConfig requires and verifies client certificates.
+func PeerCertificate(ctx context.Context) *x509.Certificate {
+	tc, ok := Conn(ctx).(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
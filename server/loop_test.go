@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/channel"
+)
+
+// testCA is a certificate authority that issues certificates for tests.
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Generating CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Creating CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Parsing CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{t: t, cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for name signed by the CA, valid for the
+// specified usage.
+func (ca *testCA) issue(name string, usage x509.ExtKeyUsage) tls.Certificate {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatalf("Generating key for %q: %v", name, err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatalf("Creating certificate for %q: %v", name, err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestLoopTLS(t *testing.T) {
+	ca := newTestCA(t)
+
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- Loop(lst, jrpc2.MapAssigner{
+			"Whoami": jrpc2.NewHandler(func(ctx context.Context) (string, error) {
+				if cert := PeerCertificate(ctx); cert != nil {
+					return cert.Subject.CommonName, nil
+				}
+				return "", nil
+			}),
+		}, &LoopOptions{
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{ca.issue("server", x509.ExtKeyUsageServerAuth)},
+				ClientCAs:    ca.pool,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+			},
+		})
+	}()
+	defer func() {
+		lst.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Loop: unexpected error: %v", err)
+		}
+	}()
+
+	dial := func(certs ...tls.Certificate) (*jrpc2.Client, error) {
+		conn, err := tls.Dial("tcp", lst.Addr().String(), &tls.Config{
+			Certificates: certs,
+			RootCAs:      ca.pool,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return jrpc2.NewClient(channel.RawJSON(conn, conn), nil), nil
+	}
+	ctx := context.Background()
+
+	// A client with a valid certificate is identified by it.
+	cli, err := dial(ca.issue("alice", x509.ExtKeyUsageClientAuth))
+	if err != nil {
+		t.Fatalf("Dial with certificate: %v", err)
+	}
+	var who string
+	if err := cli.CallResult(ctx, "Whoami", nil, &who); err != nil {
+		t.Errorf("Whoami: unexpected error: %v", err)
+	} else if who != "alice" {
+		t.Errorf("Whoami: got %q, want alice", who)
+	}
+	cli.Close()
+
+	// A client without a certificate is refused.
+	cli, err = dial()
+	if err == nil {
+		err = cli.CallResult(ctx, "Whoami", nil, &who)
+		cli.Close()
+	}
+	if err == nil {
+		t.Errorf("Whoami without a certificate: got %q, want error", who)
+	} else {
+		t.Logf("Whoami without a certificate: got expected error: %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	disconnected := make(chan net.Conn, 1)
+	srv := New(lst, jrpc2.MapAssigner{
+		"Where": jrpc2.NewHandler(func(ctx context.Context) (string, error) {
+			return Conn(ctx).RemoteAddr().String(), nil
+		}),
+		"Slow": jrpc2.NewHandler(func(ctx context.Context) (bool, error) {
+			close(started)
+			<-release
+			return true, nil
+		}),
+	}, &LoopOptions{
+		OnConnect: func(conn net.Conn) error {
+			t.Logf("Connected: %v", conn.RemoteAddr())
+			return nil
+		},
+		OnDisconnect: func(conn net.Conn, err error) {
+			t.Logf("Disconnected: %v, err=%v", conn.RemoteAddr(), err)
+			disconnected <- conn
+		},
+	})
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve() }()
+
+	conn, err := net.Dial("tcp", lst.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	cli := jrpc2.NewClient(channel.RawJSON(conn, conn), nil)
+	defer cli.Close()
+	ctx := context.Background()
+
+	// The handler can see the connection it is serving.
+	var where string
+	if err := cli.CallResult(ctx, "Where", nil, &where); err != nil {
+		t.Fatalf("Where: unexpected error: %v", err)
+	} else if want := conn.LocalAddr().String(); where != want {
+		t.Errorf("Where: got %q, want %q", where, want)
+	}
+	if n := len(srv.Conns()); n != 1 {
+		t.Errorf("Conns: got %d connections, want 1", n)
+	}
+
+	// Start a call that blocks, then shut down while it is in progress.
+	slow := make(chan error, 1)
+	go func() {
+		var ok bool
+		slow <- cli.CallResult(ctx, "Slow", nil, &ok)
+	}()
+	<-started
+	stopped := make(chan error, 1)
+	go func() { stopped <- srv.Shutdown(ctx) }()
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("Shutdown returned early (err=%v) with a call in progress", err)
+	case <-time.After(3 * shutdownPollInterval):
+	}
+
+	// Once the call completes, its response is delivered and the shutdown
+	// can finish.
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("Slow: unexpected error: %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Shutdown: unexpected error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Serve: unexpected error: %v", err)
+	}
+	select {
+	case <-disconnected:
+	default:
+		t.Error("OnDisconnect was not called")
+	}
+}
+
+func TestHandshakeStall(t *testing.T) {
+	ca := newTestCA(t)
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue("server", x509.ExtKeyUsageServerAuth)},
+	}
+
+	// stall starts a TLS server with the given handshake timeout, and connects
+	// a client that sends the start of a handshake record and then stalls.
+	stall := func(t *testing.T, timeout time.Duration) (*Server, net.Conn, <-chan error) {
+		t.Helper()
+		lst, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		srv := New(lst, jrpc2.MapAssigner{}, &LoopOptions{
+			TLSConfig:        tlsConfig,
+			HandshakeTimeout: timeout,
+		})
+		done := make(chan error, 1)
+		go func() { done <- srv.Serve() }()
+
+		conn, err := net.Dial("tcp", lst.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		if _, err := conn.Write([]byte{0x16, 0x03, 0x01}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		return srv, conn, done
+	}
+
+	// checkClosed verifies that the server closes conn.
+	checkClosed := func(t *testing.T, conn net.Conn) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Error("The stalled connection was not closed")
+		}
+	}
+
+	t.Run("Timeout", func(t *testing.T) {
+		srv, conn, done := stall(t, 50*time.Millisecond)
+		defer conn.Close()
+		checkClosed(t, conn)
+		if err := srv.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown: unexpected error: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("Serve: unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		srv, conn, done := stall(t, time.Minute)
+		defer conn.Close()
+
+		// Wait until the connection is accepted, so that it is pending.
+		for {
+			srv.mu.Lock()
+			n := len(srv.pending)
+			srv.mu.Unlock()
+			if n != 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		// Shutdown closes the pending connection, rather than waiting for its
+		// handshake to time out.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: unexpected error: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("Serve: unexpected error: %v", err)
+		}
+		checkClosed(t, conn)
+	})
+}
@@ -0,0 +1,123 @@
+package supervisor
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/herenow/jrpc2/channel"
+)
+
+// A Process is a running server subprocess, whose stdin and stdout are
+// connected to a channel.
+type Process struct {
+	cmd   *exec.Cmd
+	ch    channel.Channel
+	out   *os.File      // the read end of the stdout pipe
+	grace time.Duration // how long Close waits before killing the process
+
+	done chan struct{} // closed when the process has exited
+	err  error         // the exit status, valid once done is closed
+	once sync.Once
+}
+
+// StartProcess starts cmd, and connects its stdin and stdout to a channel
+// using the framing from opts. The Stdin and Stdout fields of cmd must not be
+// set. If opts.Logger is set, each line the process writes to stderr is
+// written to the logger; otherwise its stderr is as set in cmd.
+func StartProcess(cmd *exec.Cmd, opts *Options) (*Process, error) {
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Use an explicit pipe for stdout, rather than cmd.StdoutPipe, so that
+	// waiting for the process does not discard output not yet received.
+	out, outw, err := os.Pipe()
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	cmd.Stdout = outw
+	closers := []*os.File{outw}
+
+	logger := opts.logger()
+	var errr *os.File
+	if logger != nil {
+		var errw *os.File
+		errr, errw, err = os.Pipe()
+		if err != nil {
+			in.Close()
+			out.Close()
+			outw.Close()
+			return nil, err
+		}
+		cmd.Stderr = errw
+		closers = append(closers, errw)
+	}
+
+	err = cmd.Start()
+	for _, f := range closers {
+		f.Close() // the child has its own copies
+	}
+	if err != nil {
+		out.Close()
+		if errr != nil {
+			errr.Close()
+		}
+		return nil, err
+	}
+	if errr != nil {
+		go func() {
+			defer errr.Close()
+			s := bufio.NewScanner(errr)
+			for s.Scan() {
+				logger.Print(s.Text())
+			}
+		}()
+	}
+
+	p := &Process{
+		cmd:   cmd,
+		ch:    opts.framing()(out, in),
+		out:   out,
+		grace: opts.stopTimeout(),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		p.err = cmd.Wait()
+	}()
+	return p, nil
+}
+
+// Channel returns the channel connected to the stdin and stdout of p.
+func (p *Process) Channel() channel.Channel { return p.ch }
+
+// Pid returns the process ID of p.
+func (p *Process) Pid() int { return p.cmd.Process.Pid }
+
+// Wait blocks until p has exited, and returns its exit status as reported by
+// the Wait method of exec.Cmd.
+func (p *Process) Wait() error {
+	<-p.done
+	return p.err
+}
+
+// Close terminates p, and returns its exit status as Wait. Close first closes
+// the channel, which closes the stdin of the process; if the process does not
+// exit within the StopTimeout given in the options, it is killed.
+func (p *Process) Close() error {
+	p.once.Do(func() {
+		p.ch.Close()
+		select {
+		case <-p.done:
+		case <-time.After(p.grace):
+			p.cmd.Process.Kill()
+			<-p.done
+		}
+		p.out.Close()
+	})
+	return p.Wait()
+}
@@ -0,0 +1,298 @@
+// Package supervisor runs JSON-RPC servers as subprocesses.
+//
+// The StartProcess function starts a command whose stdin and stdout carry a
+// JSON-RPC channel, forwarding its stderr to a logger, and Close terminates
+// it. The Start function additionally connects a *jrpc2.Client to the server,
+// and supervises the process, restarting it with exponential backoff if it
+// exits unexpectedly:
+//
+//    srv, err := supervisor.Start(supervisor.Command("langserver", "--stdio"), &supervisor.Options{
+//       Framing: channel.LSP,
+//       Logger:  log.New(os.Stderr, "[langserver] ", 0),
+//       Restart: true,
+//    })
+//    if err != nil {
+//       log.Fatalf("Starting server: %v", err)
+//    }
+//    defer srv.Close()
+//    rsp, err := srv.Client().Call(ctx, "initialize", params)
+//
+// When the server is restarted, it is connected to a new client. Calls pending
+// on the previous client fail, and the caller should obtain the new client from
+// the Client method.
+package supervisor
+
+import (
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/channel"
+)
+
+// Options control the behaviour of a server started by Start or StartProcess.
+// A nil *Options provides sensible defaults.
+type Options struct {
+	// The framing used to communicate with the server. If nil, the default is
+	// channel.RawJSON.
+	Framing channel.Framing
+
+	// If not nil, the lines written by the server to stderr are sent here,
+	// along with the supervisor's own log messages.
+	Logger *log.Logger
+
+	// How long Close waits for the server to exit after closing its stdin,
+	// before it kills the process. If zero, a default of 5 seconds is used.
+	StopTimeout time.Duration
+
+	// Options for the clients connected to the server.
+	Client *jrpc2.ClientOptions
+
+	// Instructs the supervisor to restart the server if it exits before the
+	// supervisor is closed.
+	Restart bool
+
+	// The delay before the first attempt to restart the server after it exits.
+	// The delay doubles after each further failure, up to MaxBackoff, and is
+	// reset once the server has run for at least MaxBackoff. If zero, a
+	// default of 100ms is used.
+	MinBackoff time.Duration
+
+	// The longest delay before an attempt to restart the server. If zero, a
+	// default of 30 seconds is used.
+	MaxBackoff time.Duration
+
+	// If set, this function is called with the client for the server each
+	// time the server is started, including the first. This allows the caller
+	// to initialize a server after it restarts.
+	OnStart func(*jrpc2.Client)
+}
+
+func (o *Options) framing() channel.Framing {
+	if o == nil || o.Framing == nil {
+		return channel.RawJSON
+	}
+	return o.Framing
+}
+
+func (o *Options) logger() *log.Logger {
+	if o == nil {
+		return nil
+	}
+	return o.Logger
+}
+
+func (o *Options) stopTimeout() time.Duration {
+	if o == nil || o.StopTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return o.StopTimeout
+}
+
+func (o *Options) clientOptions() *jrpc2.ClientOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Client
+}
+
+func (o *Options) restart() bool { return o != nil && o.Restart }
+
+func (o *Options) backoff() (min, max time.Duration) {
+	min, max = 100*time.Millisecond, 30*time.Second
+	if o != nil && o.MinBackoff > 0 {
+		min = o.MinBackoff
+	}
+	if o != nil && o.MaxBackoff > 0 {
+		max = o.MaxBackoff
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+func (o *Options) onStart() func(*jrpc2.Client) {
+	if o == nil || o.OnStart == nil {
+		return func(*jrpc2.Client) {}
+	}
+	return o.OnStart
+}
+
+// Command returns a function that constructs a command to run the named
+// program with the given arguments, for use with Start.
+func Command(name string, args ...string) func() *exec.Cmd {
+	return func() *exec.Cmd { return exec.Command(name, args...) }
+}
+
+// A Server is a server subprocess connected to a client, whose process is
+// supervised and restarted as specified by its options.
+type Server struct {
+	newCmd  func() *exec.Cmd
+	opts    *Options
+	restart bool
+	min     time.Duration // minimum restart delay
+	max     time.Duration // maximum restart delay
+	onStart func(*jrpc2.Client)
+
+	stop chan struct{} // closed by Close
+	done chan struct{} // closed when supervision ends
+
+	mu       sync.Mutex // protects the fields below
+	proc     *Process
+	cli      *jrpc2.Client
+	restarts int
+	closed   bool
+	err      error // the exit status of the last process
+}
+
+// Start starts a server subprocess running the command constructed by newCmd,
+// and returns a Server connecting a client to it. The newCmd function is
+// called again each time the server is restarted, and must return a fresh
+// command each time.
+func Start(newCmd func() *exec.Cmd, opts *Options) (*Server, error) {
+	s := &Server{
+		newCmd:  newCmd,
+		opts:    opts,
+		restart: opts.restart(),
+		onStart: opts.onStart(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.min, s.max = opts.backoff()
+	proc, cli, err := s.launch()
+	if err != nil {
+		return nil, err
+	}
+	s.proc, s.cli = proc, cli
+	s.onStart(cli)
+	go s.supervise(proc)
+	return s, nil
+}
+
+// Client returns the client connected to the current server process. After
+// the server is restarted, Client returns a new client.
+func (s *Server) Client() *jrpc2.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cli
+}
+
+// Restarts reports the number of times the server has been restarted.
+func (s *Server) Restarts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.restarts
+}
+
+// Wait blocks until s is no longer supervising a server, either because it was
+// closed or because the server exited and was not restarted. It returns the
+// exit status of the last server process.
+func (s *Server) Wait() error {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close stops supervising the server, closes its client, and terminates the
+// server process as described for Process.Close. It returns the exit status
+// of the process.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return s.Wait()
+	}
+	s.closed = true
+	close(s.stop)
+	proc, cli := s.proc, s.cli
+	s.mu.Unlock()
+
+	cli.Close()
+	err := proc.Close()
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	return err
+}
+
+func (s *Server) log(msg string, args ...interface{}) {
+	if logger := s.opts.logger(); logger != nil {
+		logger.Printf(msg, args...)
+	}
+}
+
+// launch starts a new server process and connects a client to it.
+func (s *Server) launch() (*Process, *jrpc2.Client, error) {
+	proc, err := StartProcess(s.newCmd(), s.opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proc, jrpc2.NewClient(proc.Channel(), s.opts.clientOptions()), nil
+}
+
+// supervise waits for each server process to exit, and restarts it if
+// required, until s is closed.
+func (s *Server) supervise(proc *Process) {
+	defer close(s.done)
+	delay := s.min
+	for {
+		started := time.Now()
+		err := proc.Wait()
+		proc.Close() // release its resources
+		s.mu.Lock()
+		closed := s.closed
+		if !closed {
+			s.err = err
+		}
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+		s.log("Server exited: %v", err)
+		if !s.restart {
+			return
+		} else if time.Since(started) >= s.max {
+			delay = s.min
+		}
+
+		// Retry starting the server until it succeeds or s is closed.
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > s.max {
+				delay = s.max
+			}
+			next, cli, err := s.launch()
+			if err != nil {
+				s.log("Restarting server failed: %v", err)
+				continue
+			}
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				cli.Close()
+				next.Close()
+				return
+			}
+			old := s.cli
+			s.proc, s.cli = next, cli
+			s.restarts++
+			s.mu.Unlock()
+
+			old.Close()
+			s.log("Server restarted (pid %d)", next.Pid())
+			s.onStart(cli)
+			proc = next
+			break
+		}
+	}
+}
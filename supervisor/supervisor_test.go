@@ -0,0 +1,168 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/herenow/jrpc2"
+	"github.com/herenow/jrpc2/channel"
+)
+
+// When this variable is set in the environment, the test binary runs as a
+// server subprocess instead of running tests. Its value selects the behaviour
+// of the server when its input ends: "exit" exits, "hang" does not.
+const serverEnv = "SUPERVISOR_TEST_SERVER"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(serverEnv); mode != "" {
+		runServer(mode)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runServer(mode string) {
+	fmt.Fprintln(os.Stderr, "server starting")
+	srv := jrpc2.NewServer(jrpc2.MapAssigner{
+		"Pid": jrpc2.NewHandler(func(context.Context) (int, error) { return os.Getpid(), nil }),
+		"Crash": jrpc2.NewHandler(func(context.Context) (bool, error) {
+			os.Exit(3)
+			return false, nil
+		}),
+	}, nil).Start(channel.RawJSON(os.Stdin, os.Stdout))
+	srv.Wait()
+	if mode == "hang" {
+		time.Sleep(time.Minute)
+	}
+}
+
+// serverCommand returns a function that constructs a command to run the test
+// binary as a server in the given mode.
+func serverCommand(mode string) func() *exec.Cmd {
+	return func() *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), serverEnv+"="+mode)
+		return cmd
+	}
+}
+
+// lineWriter is an io.Writer that delivers each write to a channel, for use
+// with a log.Logger, which writes each message in a single call.
+type lineWriter chan string
+
+func (w lineWriter) Write(data []byte) (int, error) {
+	select {
+	case w <- strings.TrimSpace(string(data)):
+	default:
+	}
+	return len(data), nil
+}
+
+func pid(t *testing.T, cli *jrpc2.Client) int {
+	t.Helper()
+	var pid int
+	if err := cli.CallResult(context.Background(), "Pid", nil, &pid); err != nil {
+		t.Fatalf("Call(Pid): unexpected error: %v", err)
+	}
+	return pid
+}
+
+func TestProcess(t *testing.T) {
+	lines := make(lineWriter, 10)
+	proc, err := StartProcess(serverCommand("exit")(), &Options{Logger: log.New(lines, "", 0)})
+	if err != nil {
+		t.Fatalf("StartProcess: unexpected error: %v", err)
+	}
+	cli := jrpc2.NewClient(proc.Channel(), nil)
+	if got := pid(t, cli); got != proc.Pid() {
+		t.Errorf("Pid: got %d, want %d", got, proc.Pid())
+	}
+	select {
+	case line := <-lines:
+		if line != "server starting" {
+			t.Errorf("Stderr: got %q, want %q", line, "server starting")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Stderr: no output was logged")
+	}
+
+	// Closing the process closes its stdin, and it exits normally.
+	if err := proc.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	cli.Close()
+}
+
+func TestKill(t *testing.T) {
+	proc, err := StartProcess(serverCommand("hang")(), &Options{StopTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("StartProcess: unexpected error: %v", err)
+	}
+	// The process does not exit when its stdin closes, so it is killed.
+	if err := proc.Close(); err == nil {
+		t.Error("Close: got nil error, want the process to be killed")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	started := make(chan *jrpc2.Client, 2)
+	srv, err := Start(serverCommand("exit"), &Options{
+		Restart:    true,
+		MinBackoff: 10 * time.Millisecond,
+		OnStart:    func(cli *jrpc2.Client) { started <- cli },
+	})
+	if err != nil {
+		t.Fatalf("Start: unexpected error: %v", err)
+	}
+	if cli := <-started; cli != srv.Client() {
+		t.Error("OnStart: got a different client than Client")
+	}
+	first := pid(t, srv.Client())
+
+	// The call fails because the server crashes, and it is restarted.
+	if _, err := srv.Client().Call(context.Background(), "Crash", nil); err == nil {
+		t.Error("Call(Crash): got nil error, want error")
+	}
+	select {
+	case cli := <-started:
+		if second := pid(t, cli); second == first {
+			t.Errorf("Pid after restart: got %d, want a new process", second)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The server was not restarted")
+	}
+	if n := srv.Restarts(); n != 1 {
+		t.Errorf("Restarts: got %d, want 1", n)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if err := srv.Wait(); err != nil {
+		t.Errorf("Wait: unexpected error: %v", err)
+	}
+}
+
+func TestNoRestart(t *testing.T) {
+	srv, err := Start(serverCommand("exit"), nil)
+	if err != nil {
+		t.Fatalf("Start: unexpected error: %v", err)
+	}
+	srv.Client().Notify(context.Background(), "Crash", nil)
+
+	// Without Restart, supervision ends when the server exits.
+	err = srv.Wait()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 3 {
+		t.Errorf("Wait: got %v, want exit status 3", err)
+	}
+	if n := srv.Restarts(); n != 0 {
+		t.Errorf("Restarts: got %d, want 0", n)
+	}
+	srv.Close()
+}